@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ----------- LISTA PÚBLICA (filtros, orden y paginación) -------------
+// GET /estacionamientos
+//   zona:     ?lat=&lng=&radio_m= | ?bbox= (ver geo.go)
+//   filtros:  techado=si,parcial  seguridad=camaras,vigilante  banos=true
+//             precio_max=1500  altura_m=2.1  abierto_ahora=true (ver horarios.go)  min_libres=3
+//   orden:    orden=distancia|precio|libres (por defecto distancia si hay punto)
+//   página:   limite=50  cursor=<siguiente de la respuesta anterior>
+// Filtros, orden, corte por cursor y LIMIT van en SQL (la distancia también,
+// ver geo.go, salvo con GEO_BUSQUEDA=memoria); solo abierto_ahora se filtra en Go con el horario, pidiendo
+// más filas hasta completar la página. libres descuenta las reservas que
+// cubren ahora (ver reservas.go).
+
+const (
+	limiteListaDefault = 50
+	limiteListaMaximo  = 200
+)
+
+// cursorLista apunta al último elemento devuelto: valor del orden e id.
+type cursorLista struct {
+	Valor float64 `json:"v"`
+	ID    int64   `json:"id"`
+}
+
+func (cl cursorLista) codificar() string {
+	b, _ := json.Marshal(cl)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodificarCursor(s string) (cursorLista, bool) {
+	var cl cursorLista
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return cl, err == nil && json.Unmarshal(b, &cl) == nil
+}
+
+type itemLista struct {
+	ID         int64    `json:"id"`
+	Nombre     string   `json:"nombre"`
+	Latitud    float64  `json:"latitud"`
+	Longitud   float64  `json:"longitud"`
+	Precio     *float64 `json:"precio"`
+	Techado    *string  `json:"techado"`
+	Seguridad  []string `json:"seguridad"`
+	Banos      bool     `json:"banos"`
+	AlturaMaxM *float64 `json:"altura_max_m"`
+	Total      int      `json:"total"`
+	Ocupados   int      `json:"ocupados"`
+	Reservados int      `json:"reservados"`
+	Libres     int      `json:"libres"`
+	DistanciaM *float64 `json:"distancia_m,omitempty"`
+	estadoHorario
+	// distancia sin redondear, para el cursor
+	distancia float64
+}
+
+// filtrosLista arma el WHERE/HAVING a partir de la query.
+type filtrosLista struct {
+	where  []string
+	args   []interface{}
+	having []string
+	hArgs  []interface{}
+	// soloAbiertos se resuelve en Go con el horario (ver horarios.go)
+	soloAbiertos bool
+}
+
+func parsearFiltrosLista(c *gin.Context) (filtrosLista, []errorValidacion) {
+	f := filtrosLista{where: []string{"e.eliminado_at IS NULL"}}
+	var errs []errorValidacion
+	invalido := func(campo, motivo string) {
+		errs = append(errs, errorValidacion{Campo: campo, Motivo: motivo})
+	}
+	lista := func(campo string) []string {
+		var out []string
+		for _, v := range strings.Split(c.Query(campo), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+
+	if vals := lista("techado"); len(vals) > 0 {
+		marcas := make([]string, len(vals))
+		for i, v := range vals {
+			if !contiene([]string{"si", "no", "parcial"}, v) {
+				invalido("techado", "valores posibles: si, no, parcial")
+			}
+			marcas[i] = "?"
+			f.args = append(f.args, v)
+		}
+		f.where = append(f.where, "e.techado IN ("+strings.Join(marcas, ", ")+")")
+	}
+	for _, v := range lista("seguridad") {
+		if !seguridadPermitida[v] {
+			invalido("seguridad", "valores posibles: camaras, vigilante")
+			continue
+		}
+		f.where = append(f.where, "FIND_IN_SET(?, e.seguridad) > 0")
+		f.args = append(f.args, v)
+	}
+	if v, ok := c.GetQuery("banos"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			invalido("banos", "debe ser true o false")
+		} else {
+			f.where = append(f.where, "IFNULL(e.banos, 0) = ?")
+			f.args = append(f.args, b)
+		}
+	}
+	if v, ok := c.GetQuery("precio_max"); ok {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 {
+			invalido("precio_max", "debe ser un número mayor o igual a 0")
+		} else {
+			f.where = append(f.where, "e.precio_por_hora IS NOT NULL AND e.precio_por_hora <= ?")
+			f.args = append(f.args, p)
+		}
+	}
+	if v, ok := c.GetQuery("altura_m"); ok {
+		h, err := strconv.ParseFloat(v, 64)
+		if err != nil || h <= 0 {
+			invalido("altura_m", "debe ser un número mayor a 0")
+		} else {
+			f.where = append(f.where, "(e.altura_max_m IS NULL OR e.altura_max_m >= ?)")
+			f.args = append(f.args, h)
+		}
+	}
+	if v, ok := c.GetQuery("abierto_ahora"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			invalido("abierto_ahora", "debe ser true o false")
+		} else {
+			f.soloAbiertos = b
+		}
+	}
+	if v, ok := c.GetQuery("min_libres"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			invalido("min_libres", "debe ser un entero mayor o igual a 0")
+		} else {
+			f.having = append(f.having, libresSQL+" >= ?")
+			f.hArgs = append(f.hArgs, n)
+		}
+	}
+	return f, errs
+}
+
+// libresSQL son los lugares libres de la fila agrupada (usa el alias
+// reservados del SELECT).
+const libresSQL = "GREATEST(0, COUNT(l.numero) - COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END),0) - reservados)"
+
+// valorOrden devuelve la clave por la que se ordena (ascendente) cada item;
+// es el valor de ordenSQL para esa fila.
+func valorOrden(orden string, it itemLista) float64 {
+	switch orden {
+	case "distancia":
+		return it.distancia
+	case "precio":
+		if it.Precio == nil {
+			return math.MaxFloat64 // sin precio al final
+		}
+		return *it.Precio
+	case "libres":
+		return -float64(it.Libres) // más libres primero
+	}
+	return float64(it.ID)
+}
+
+// ordenSQL devuelve la expresión de la clave de orden y si es un agregado
+// (el corte por cursor va en HAVING en vez de WHERE).
+func ordenSQL(orden string, zona zonaGeo) (string, bool) {
+	switch orden {
+	case "distancia":
+		return zona.distanciaSQL(), false
+	case "precio":
+		return "IFNULL(e.precio_por_hora, " + numSQL(math.MaxFloat64) + ")", false
+	case "libres":
+		return "-" + libresSQL, true
+	}
+	return "e.id", false
+}
+
+// consultarLista trae hasta lote estacionamientos que cumplen los filtros,
+// en orden y después del cursor.
+func consultarLista(zona zonaGeo, f filtrosLista, orden string, cursor *cursorLista, lote int, ahora time.Time) ([]itemLista, error) {
+	where := append([]string{}, f.where...)
+	args := append([]interface{}{ahora, ahora}, f.args...)
+	having := append([]string{}, f.having...)
+	hArgs := append([]interface{}{}, f.hArgs...)
+	// con la distancia en Go, orden, cursor y lote se aplican al final
+	enGo := zona.ConPunto && distanciaEnGo()
+
+	distancia := "NULL"
+	if d := zona.distanciaSQL(); d != "" {
+		distancia = d
+		if zona.RadioM > 0 {
+			where = append(where, d+" <= "+numSQL(zona.RadioM))
+		}
+	}
+	if zona.Caja != nil {
+		cond, a := zona.Caja.filtroSQL()
+		where = append(where, cond)
+		args = append(args, a...)
+	}
+	clave, agregada := ordenSQL(orden, zona)
+	if cursor != nil && !enGo {
+		cond := "(" + clave + " > ? OR (" + clave + " = ? AND e.id > ?))"
+		a := []interface{}{cursor.Valor, cursor.Valor, cursor.ID}
+		if agregada {
+			having, hArgs = append(having, cond), append(hArgs, a...)
+		} else {
+			where, args = append(where, cond), append(args, a...)
+		}
+	}
+
+	q := `
+		SELECT e.id, e.nombre, e.latitud, e.longitud,
+		       e.precio_por_hora, e.techado, IFNULL(e.seguridad, ''), IFNULL(e.banos, 0), e.altura_max_m,
+		       COUNT(l.numero), COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END),0),
+		       ` + reservadosSQL + ` AS reservados, ` + distancia + `
+		FROM estacionamientos e
+		LEFT JOIN lugares l ON l.estacionamiento_id = e.id
+		WHERE ` + strings.Join(where, " AND ") + `
+		GROUP BY e.id`
+	if len(having) > 0 {
+		q += ` HAVING ` + strings.Join(having, " AND ")
+	}
+	if !enGo {
+		q += fmt.Sprintf(" ORDER BY %s, e.id LIMIT %d", clave, lote)
+	}
+	rows, err := db.Query(q, append(args, hArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []itemLista{}
+	for rows.Next() {
+		var (
+			it    itemLista
+			seg   string
+			banos int
+			dist  *float64
+		)
+		if err := rows.Scan(&it.ID, &it.Nombre, &it.Latitud, &it.Longitud,
+			&it.Precio, &it.Techado, &seg, &banos, &it.AlturaMaxM, &it.Total, &it.Ocupados, &it.Reservados, &dist); err != nil {
+			return nil, err
+		}
+		if dist != nil {
+			it.distancia = *dist
+			d := math.Round(*dist)
+			it.DistanciaM = &d
+		}
+		it.Seguridad = []string{}
+		if seg != "" {
+			it.Seguridad = strings.Split(seg, ",")
+		}
+		it.Banos = banos == 1
+		it.Libres = max(0, it.Total-it.Ocupados-it.Reservados)
+		list = append(list, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if enGo {
+		list = distanciasEnGo(list, zona, orden, cursor, lote)
+	}
+	return list, nil
+}
+
+// distanciasEnGo completa la distancia de cada item con haversineM, descarta
+// los que quedan fuera del radio y aplica orden, cursor y lote como lo haría
+// consultarLista en SQL.
+func distanciasEnGo(list []itemLista, zona zonaGeo, orden string, cursor *cursorLista, lote int) []itemLista {
+	out := list[:0]
+	for _, it := range list {
+		it.distancia = haversineM(zona.Lat, zona.Lng, it.Latitud, it.Longitud)
+		if zona.RadioM > 0 && it.distancia > zona.RadioM {
+			continue
+		}
+		d := math.Round(it.distancia)
+		it.DistanciaM = &d
+		if cursor != nil {
+			if v := valorOrden(orden, it); v < cursor.Valor || (v == cursor.Valor && it.ID <= cursor.ID) {
+				continue
+			}
+		}
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := valorOrden(orden, out[i]), valorOrden(orden, out[j])
+		return a < b || (a == b && out[i].ID < out[j].ID)
+	})
+	if len(out) > lote {
+		out = out[:lote]
+	}
+	return out
+}
+
+// conHorario completa abierto_ahora/abre_a/cierra_a de los items.
+func conHorario(list []itemLista, ahora time.Time) ([]itemLista, error) {
+	ids := make([]int64, len(list))
+	for i, it := range list {
+		ids[i] = it.ID
+	}
+	desde, hasta := ventanaEstado(ahora)
+	horarios, err := cargarHorarios(ids, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].estadoHorario = horarios[list[i].ID].estado(ahora)
+	}
+	return list, nil
+}
+
+func registrarRutasBusqueda(r *gin.Engine) {
+	// Lista pública de estacionamientos (mapa)
+	r.GET("/estacionamientos", func(c *gin.Context) {
+		zona, errs := parsearZonaGeo(c)
+		filtros, errsF := parsearFiltrosLista(c)
+		errs = append(errs, errsF...)
+
+		orden := c.DefaultQuery("orden", "")
+		switch orden {
+		case "":
+			orden = "id"
+			if zona.ConPunto {
+				orden = "distancia"
+			}
+		case "distancia":
+			if !zona.ConPunto {
+				errs = append(errs, errorValidacion{Campo: "orden", Motivo: "distancia requiere lat/lng o bbox"})
+			}
+		case "precio", "libres":
+		default:
+			errs = append(errs, errorValidacion{Campo: "orden", Motivo: "valores posibles: distancia, precio, libres"})
+		}
+
+		limite := limiteListaDefault
+		if v, ok := c.GetQuery("limite"); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > limiteListaMaximo {
+				errs = append(errs, errorValidacion{Campo: "limite", Motivo: fmt.Sprintf("debe estar entre 1 y %d", limiteListaMaximo)})
+			}
+			limite = n
+		}
+		var cursor *cursorLista
+		if v, ok := c.GetQuery("cursor"); ok {
+			cl, ok := decodificarCursor(v)
+			if !ok {
+				errs = append(errs, errorValidacion{Campo: "cursor", Motivo: "inválido"})
+			}
+			cursor = &cl
+		}
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+
+		// sin abierto_ahora alcanza una consulta; con abierto_ahora se piden
+		// lotes más grandes y se sigue desde la última fila vista hasta
+		// completar la página o agotar los resultados
+		ahora := time.Now()
+		lote := limite + 1
+		if filtros.soloAbiertos {
+			lote *= 4
+		}
+		list := []itemLista{}
+		for {
+			filas, err := consultarLista(zona, filtros, orden, cursor, lote, ahora)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if len(filas) == 0 {
+				break
+			}
+			agotado := len(filas) < lote
+			ult := filas[len(filas)-1]
+			cursor = &cursorLista{Valor: valorOrden(orden, ult), ID: ult.ID}
+			if filtros.soloAbiertos {
+				if filas, err = conHorario(filas, ahora); err != nil {
+					dbErr(c, err)
+					return
+				}
+				abiertos := filas[:0]
+				for _, it := range filas {
+					if it.AbiertoAhora != nil && *it.AbiertoAhora {
+						abiertos = append(abiertos, it)
+					}
+				}
+				filas = abiertos
+			}
+			list = append(list, filas...)
+			if len(list) > limite || agotado {
+				break
+			}
+		}
+
+		var siguiente *string
+		if len(list) > limite {
+			list = list[:limite]
+			ult := list[limite-1]
+			s := cursorLista{Valor: valorOrden(orden, ult), ID: ult.ID}.codificar()
+			siguiente = &s
+		}
+		if !filtros.soloAbiertos {
+			var err error
+			if list, err = conHorario(list, ahora); err != nil {
+				dbErr(c, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"estacionamientos": list, "siguiente": siguiente})
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// Los tests de integración corren contra la MySQL de TEST_MYSQL_URL (nunca
+// MYSQL_URL, que por defecto apunta a producción) y se saltean si no está.
+// La base tiene que ser descartable: se crean las tablas y se vacían.
+
+// tablasBase son las tablas que el backend no crea (las arma el proyecto
+// original); acá van solo las columnas que usa el código, el resto lo
+// agrega asegurarEsquema.
+var tablasBase = []string{
+	`CREATE TABLE IF NOT EXISTS usuarios (
+		id            INT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		email         VARCHAR(255) NOT NULL UNIQUE,
+		password_hash VARCHAR(255) NOT NULL,
+		vip           TINYINT(1)   NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS estacionamientos (
+		id              INT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		duenio_id       INT          NOT NULL,
+		nombre          VARCHAR(100) NOT NULL,
+		cantidad        INT          NOT NULL DEFAULT 0,
+		latitud         DOUBLE       NOT NULL,
+		longitud        DOUBLE       NOT NULL,
+		precio_por_hora DECIMAL(10,2) NULL,
+		techado         VARCHAR(16)  NULL,
+		seguridad       VARCHAR(64)  NULL,
+		banos           TINYINT(1)   NULL,
+		altura_max_m    DECIMAL(4,2) NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS lugares (
+		estacionamiento_id INT        NOT NULL,
+		numero             INT        NOT NULL,
+		ocupado            TINYINT(1) NOT NULL DEFAULT 0,
+		PRIMARY KEY (estacionamiento_id, numero)
+	)`,
+	`CREATE TABLE IF NOT EXISTS dias_atencion (
+		estacionamiento_id INT         NOT NULL,
+		dia                VARCHAR(32) NOT NULL,
+		desde              VARCHAR(8)  NOT NULL,
+		hasta              VARCHAR(8)  NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS reservas (
+		user_id            INT        NOT NULL,
+		estacionamiento_id INT        NOT NULL,
+		status             TINYINT(1) NOT NULL DEFAULT 1,
+		canceled_at        DATETIME   NULL
+	)`,
+}
+
+// tablasPrueba se vacían antes de cada test.
+var tablasPrueba = []string{
+	"usuarios", "estacionamientos", "lugares", "dias_atencion", "reservas",
+	"reservas_historial", "vehiculos", "usuario_roles", "sesiones", "excepciones_horario",
+}
+
+var esquemaPrueba sync.Once
+
+// dbPrueba conecta db a la base de prueba, crea el esquema la primera vez y
+// vacía las tablas.
+func dbPrueba(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("TEST_MYSQL_URL")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_URL no configurado")
+	}
+	esquemaPrueba.Do(func() {
+		var err error
+		if db, err = sql.Open("mysql", dsn); err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range tablasBase {
+			if _, err := db.Exec(q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		asegurarEsquema()
+		if os.Getenv("JWT_KEYS_SECRET") == "" {
+			os.Setenv("JWT_KEYS_SECRET", "secreto-de-prueba-de-al-menos-32-caracteres")
+		}
+		iniciarLlavesJWT()
+	})
+	if db == nil {
+		t.Fatal("no se pudo abrir la base de prueba")
+	}
+	for _, tabla := range tablasPrueba {
+		if _, err := db.Exec("TRUNCATE TABLE " + tabla); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// motorPrueba arma un router con el middleware de errores y las
+// validaciones, como main; cada test registra sus rutas.
+func motorPrueba() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(errores.Middleware())
+	registrarValidaciones()
+	return r
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- API KEYS DE DISPOSITIVOS -------------
+// Sensores y barreras no pueden hacer login: el dueño les genera una API key
+// atada a un solo estacionamiento. La key se muestra una única vez y se guarda
+// hasheada. Con X-Api-Key solo se accede a las rutas de /dispositivo.
+
+const prefijoAPIKey = "pk_"
+
+// cada cuánto se actualiza last_used_at como máximo (evita un UPDATE por request)
+const apiKeyUsoResolucion = time.Minute
+
+func nuevaAPIKey() (key, prefijo string, err error) {
+	secreto, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	key = prefijoAPIKey + secreto
+	return key, key[:len(prefijoAPIKey)+8], nil
+}
+
+// APIKeyMiddleware autentica dispositivos por X-Api-Key y deja en el contexto
+// apiKeyID y estacionamientoID.
+func APIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader("X-Api-Key"))
+		if key == "" || !strings.HasPrefix(key, prefijoAPIKey) {
+			fallar(c, errores.APIKeyFaltante)
+			return
+		}
+
+		// la key de un estacionamiento dado de baja deja de valer aunque no
+		// se haya revocado
+		var keyID, estID int
+		err := db.QueryRow(`
+			SELECT k.id, k.estacionamiento_id FROM api_keys k
+			JOIN estacionamientos e ON e.id = k.estacionamiento_id AND e.eliminado_at IS NULL
+			WHERE k.key_hash = ? AND k.revoked_at IS NULL`, hashToken(key),
+		).Scan(&keyID, &estID)
+		if err == sql.ErrNoRows {
+			fallar(c, errores.APIKeyInvalida)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			c.Abort()
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec(`
+			UPDATE api_keys SET last_used_at = ?
+			WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+			now, keyID, now.Add(-apiKeyUsoResolucion)); err != nil {
+			dbErr(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Set("apiKeyID", keyID)
+		c.Set("estacionamientoID", estID)
+		c.Next()
+	}
+}
+
+func actualizarEstadoLugar(estID, numero int, ocupado bool) (bool, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM lugares WHERE estacionamiento_id=? AND numero=?`, estID, numero).Scan(&n); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := db.Exec(`UPDATE lugares SET ocupado=? WHERE estacionamiento_id=? AND numero=?`, ocupado, estID, numero); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// vehiculoDeEvento resuelve la patente que manda un dispositivo. La patente
+// no es única entre usuarios y el evento marca la llegada de la reserva (ver
+// vencimientos.go): con varios vehículos se toma el único que tenga una
+// reserva activa en el estacionamiento; si no queda uno solo, nil y el
+// evento se guarda solo con la patente.
+func vehiculoDeEvento(estID int, patente string) (*Vehiculo, error) {
+	rows, err := db.Query(`
+		SELECT `+columnasVehiculo+`, EXISTS (SELECT 1 FROM reservas r
+		                 WHERE r.vehiculo_id = vehiculos.id AND r.estacionamiento_id = ? AND r.status = 1)
+		FROM vehiculos WHERE patente = ?`, estID, patente)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var todos, conReserva []Vehiculo
+	for rows.Next() {
+		var reserva bool
+		v, err := scanVehiculo(rows, &reserva)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, v)
+		if reserva {
+			conReserva = append(conReserva, v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(todos) == 1:
+		return &todos[0], nil
+	case len(conReserva) == 1:
+		return &conReserva[0], nil
+	}
+	return nil, nil
+}
+
+func registrarRutasDispositivos(r *gin.Engine) {
+	gestion := RequirePermissionEn(estIDParam("id"), permDispositivosGestionar)
+
+	// POST /estacionamientos/:id/api-keys { "nombre": "Barrera entrada" }
+	r.POST("/estacionamientos/:id/api-keys", AuthMiddleware(), gestion, func(c *gin.Context) {
+		var body struct {
+			Nombre string `json:"nombre"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Nombre) == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		key, prefijo, err := nuevaAPIKey()
+		if err != nil {
+			fallar(c, errores.Interno)
+			return
+		}
+		res, err := db.Exec(`
+			INSERT INTO api_keys (estacionamiento_id, nombre, prefijo, key_hash, created_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			c.GetInt("estacionamientoID"), strings.TrimSpace(body.Nombre), prefijo, hashToken(key),
+			c.GetInt("userID"), time.Now())
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		id, _ := res.LastInsertId()
+		// la key en claro solo se devuelve acá
+		c.JSON(http.StatusCreated, gin.H{"id": id, "nombre": body.Nombre, "prefijo": prefijo, "api_key": key})
+	})
+
+	// GET /estacionamientos/:id/api-keys
+	r.GET("/estacionamientos/:id/api-keys", AuthMiddleware(), gestion, func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT id, nombre, prefijo, created_at, last_used_at, revoked_at
+			FROM api_keys WHERE estacionamiento_id = ?
+			ORDER BY created_at DESC`, c.GetInt("estacionamientoID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+
+		type Item struct {
+			ID         int        `json:"id"`
+			Nombre     string     `json:"nombre"`
+			Prefijo    string     `json:"prefijo"`
+			CreadaEn   time.Time  `json:"created_at"`
+			UltimoUso  *time.Time `json:"last_used_at"`
+			RevocadaEn *time.Time `json:"revoked_at"`
+		}
+		list := []Item{}
+		for rows.Next() {
+			var it Item
+			var uso, rev sql.NullTime
+			if err := rows.Scan(&it.ID, &it.Nombre, &it.Prefijo, &it.CreadaEn, &uso, &rev); err == nil {
+				if uso.Valid {
+					it.UltimoUso = &uso.Time
+				}
+				if rev.Valid {
+					it.RevocadaEn = &rev.Time
+				}
+				list = append(list, it)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"api_keys": list})
+	})
+
+	// DELETE /estacionamientos/:id/api-keys/:keyId
+	r.DELETE("/estacionamientos/:id/api-keys/:keyId", AuthMiddleware(), gestion, func(c *gin.Context) {
+		keyID, err := strconv.Atoi(c.Param("keyId"))
+		if err != nil || keyID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		res, err := db.Exec(`
+			UPDATE api_keys SET revoked_at = ?
+			WHERE id = ? AND estacionamiento_id = ? AND revoked_at IS NULL`,
+			time.Now(), keyID, c.GetInt("estacionamientoID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			fallar(c, errores.APIKeyNoEncontrada)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	disp := r.Group("/dispositivo", APIKeyMiddleware())
+
+	// POST /dispositivo/lugares/estado { "numero": 3, "ocupado": true }
+	disp.POST("/lugares/estado", func(c *gin.Context) {
+		var in struct {
+			Numero  int   `json:"numero"`
+			Ocupado *bool `json:"ocupado"`
+		}
+		if err := c.ShouldBindJSON(&in); err != nil || in.Numero <= 0 || in.Ocupado == nil {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		ok, err := actualizarEstadoLugar(c.GetInt("estacionamientoID"), in.Numero, *in.Ocupado)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.LugarNoEncontrado)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"mensaje": "OK"})
+	})
+
+	// POST /dispositivo/eventos { "tipo": "entrada"|"salida", "numero": 3, "patente": "AB123CD" }
+	// Si viene numero, la entrada ocupa el lugar y la salida lo libera.
+	disp.POST("/eventos", func(c *gin.Context) {
+		var in struct {
+			Tipo    string     `json:"tipo" binding:"required,oneof=entrada salida"`
+			Numero  *int       `json:"numero"`
+			Patente *string    `json:"patente" binding:"omitempty,max=16"`
+			Fecha   *time.Time `json:"fecha"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		estID := c.GetInt("estacionamientoID")
+		fecha := time.Now()
+		if in.Fecha != nil {
+			fecha = *in.Fecha
+		}
+
+		// si la patente es de un vehículo registrado se valida que entre
+		var vehiculoID *int
+		if in.Patente != nil && *in.Patente != "" {
+			p := normalizarPatente(*in.Patente)
+			in.Patente = &p
+			v, err := vehiculoDeEvento(estID, p)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if v != nil {
+				vehiculoID = &v.ID
+				if in.Tipo == "entrada" {
+					numero := 0
+					if in.Numero != nil {
+						numero = *in.Numero
+					}
+					if err := validarVehiculoEnEstacionamiento(*v, estID, numero); err != nil {
+						if !errorVehiculoJSON(c, err) {
+							dbErr(c, err)
+						}
+						return
+					}
+				}
+			}
+		}
+
+		if in.Numero != nil {
+			ok, err := actualizarEstadoLugar(estID, *in.Numero, in.Tipo == "entrada")
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if !ok {
+				fallar(c, errores.LugarNoEncontrado)
+				return
+			}
+		}
+
+		res, err := db.Exec(`
+			INSERT INTO eventos_acceso (estacionamiento_id, api_key_id, tipo, numero, patente, vehiculo_id, ocurrido_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			estID, c.GetInt("apiKeyID"), in.Tipo, in.Numero, in.Patente, vehiculoID, fecha)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		id, _ := res.LastInsertId()
+		c.JSON(http.StatusCreated, gin.H{"id": id})
+	})
+}
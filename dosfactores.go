@@ -0,0 +1,457 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- 2FA (TOTP) -------------
+// Login en dos pasos: si el usuario tiene 2FA (o se le exige por ser dueño),
+// /login devuelve un challenge_token que se canjea en /login/2fa junto con el
+// código TOTP o un código de recuperación. Cada challenge admite
+// challenge2FAIntentos códigos y /login/2fa tiene además límite por IP y por
+// usuario; los intentos del login se perdonan recién al pasar el segundo factor.
+
+const (
+	token2FA             = "2fa"
+	challenge2FATTL      = 5 * time.Minute
+	challenge2FAIntentos = 5
+	codigosRecuperacion  = 10
+)
+
+var (
+	err2FAYaActivo   = errors.New("2FA ya activo")
+	err2FANoEnrolado = errors.New("2FA no enrolado")
+)
+
+func totpIssuer() string {
+	if v := os.Getenv("TOTP_ISSUER"); v != "" {
+		return v
+	}
+	return "Parking"
+}
+
+// requiere2FA indica si la política obliga al usuario a usar 2FA
+// (REQUIRE_2FA_OWNERS=true y es dueño de algún estacionamiento).
+func requiere2FA(userID int) (bool, error) {
+	if os.Getenv("REQUIRE_2FA_OWNERS") != "true" {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRow(`SELECT COUNT(1) FROM estacionamientos WHERE duenio_id = ? AND eliminado_at IS NULL`, userID).Scan(&n)
+	return n > 0, err
+}
+
+func tiene2FAActivo(userID int) (bool, error) {
+	var activo int
+	err := db.QueryRow(`SELECT activo FROM usuario_2fa WHERE user_id = ?`, userID).Scan(&activo)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return activo == 1, err
+}
+
+func normalizarCodigoRecuperacion(c string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(c), "-", ""))
+}
+
+// iniciarEnrolamiento2FA genera secreto y códigos de recuperación nuevos.
+// El 2FA queda inactivo hasta que se valide el primer código.
+func iniciarEnrolamiento2FA(userID int, email string) (gin.H, error) {
+	if activo, err := tiene2FAActivo(userID); err != nil || activo {
+		if err == nil {
+			err = err2FAYaActivo
+		}
+		return nil, err
+	}
+	secreto, err := nuevoSecretoTOTP()
+	if err != nil {
+		return nil, err
+	}
+	codigos := make([]string, 0, codigosRecuperacion)
+	for i := 0; i < codigosRecuperacion; i++ {
+		raw, err := nuevoSecretoTOTP()
+		if err != nil {
+			return nil, err
+		}
+		raw = strings.ToLower(raw[:10])
+		codigos = append(codigos, raw[:5]+"-"+raw[5:])
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		INSERT INTO usuario_2fa (user_id, secreto, activo, ultimo_paso, created_at)
+		VALUES (?, ?, 0, 0, ?)
+		ON DUPLICATE KEY UPDATE secreto = VALUES(secreto), activo = 0, ultimo_paso = 0, created_at = VALUES(created_at)`,
+		userID, secreto, time.Now()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM codigos_recuperacion WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	for _, cod := range codigos {
+		if _, err := tx.Exec(`INSERT INTO codigos_recuperacion (user_id, code_hash) VALUES (?, ?)`,
+			userID, hashToken(normalizarCodigoRecuperacion(cod))); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"secreto":              secreto,
+		"otpauth_uri":          totpURI(totpIssuer(), email, secreto),
+		"codigos_recuperacion": codigos,
+	}, nil
+}
+
+// verificarSegundoFactor valida un código TOTP (y activa el 2FA si estaba
+// pendiente) o consume un código de recuperación.
+func verificarSegundoFactor(userID int, codigo, recuperacion string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		secreto    string
+		activo     int
+		ultimoPaso int64
+	)
+	err = tx.QueryRow(`SELECT secreto, activo, ultimo_paso FROM usuario_2fa WHERE user_id = ? FOR UPDATE`, userID).
+		Scan(&secreto, &activo, &ultimoPaso)
+	if err == sql.ErrNoRows {
+		return false, err2FANoEnrolado
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if recuperacion != "" {
+		if activo != 1 {
+			return false, nil
+		}
+		res, err := tx.Exec(`
+			UPDATE codigos_recuperacion SET used_at = ?
+			WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+			time.Now(), userID, hashToken(normalizarCodigoRecuperacion(recuperacion)))
+		if err != nil {
+			return false, err
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			return false, nil
+		}
+		return true, tx.Commit()
+	}
+
+	paso, ok := validarTOTP(secreto, codigo, time.Now(), ultimoPaso)
+	if !ok {
+		return false, nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE usuario_2fa
+		SET ultimo_paso = ?, activo = 1, activado_at = IFNULL(activado_at, ?)
+		WHERE user_id = ?`, paso, time.Now(), userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// desafio2FA decide si el login necesita segundo factor y, si es así, arma
+// la respuesta con el challenge_token.
+func desafio2FA(u User) (gin.H, bool, error) {
+	activo, err := tiene2FAActivo(u.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	requerido := false
+	if !activo {
+		if requerido, err = requiere2FA(u.ID); err != nil {
+			return nil, false, err
+		}
+	}
+	if !activo && !requerido {
+		return nil, false, nil
+	}
+	challenge, err := crearTokenUsuario(u.ID, token2FA, u.Email, challenge2FATTL)
+	if err != nil {
+		return nil, false, err
+	}
+	return gin.H{
+		"requiere_2fa":    true,
+		"enrolar":         !activo,
+		"challenge_token": challenge,
+		"expires_in":      int(challenge2FATTL.Seconds()),
+	}, true, nil
+}
+
+// usuarioDeChallenge2FA valida el challenge sin consumirlo.
+func usuarioDeChallenge2FA(token string) (int, error) {
+	var (
+		userID    int
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		intentos  int
+	)
+	err := db.QueryRow(`
+		SELECT user_id, expires_at, used_at, intentos
+		FROM tokens_usuario WHERE token_hash = ? AND tipo = ?`, hashToken(token), token2FA,
+	).Scan(&userID, &expiresAt, &usedAt, &intentos)
+	if err == sql.ErrNoRows {
+		return 0, errTokenInvalido
+	}
+	if err != nil {
+		return 0, err
+	}
+	if usedAt.Valid || time.Now().After(expiresAt) || intentos >= challenge2FAIntentos {
+		return 0, errTokenInvalido
+	}
+	return userID, nil
+}
+
+// intentarChallenge2FA gasta un intento del challenge y devuelve su
+// usuario. Control y suma van en un solo UPDATE condicional, así los pedidos
+// concurrentes no pueden pasar del máximo.
+func intentarChallenge2FA(token string) (int, error) {
+	h := hashToken(token)
+	res, err := db.Exec(`
+		UPDATE tokens_usuario SET intentos = intentos + 1
+		WHERE token_hash = ? AND tipo = ? AND used_at IS NULL AND expires_at > ? AND intentos < ?`,
+		h, token2FA, time.Now(), challenge2FAIntentos)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, errTokenInvalido
+	}
+	var userID int
+	if err := db.QueryRow(`SELECT user_id FROM tokens_usuario WHERE token_hash = ?`, h).Scan(&userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// consumirChallenge2FA marca el challenge como usado; falla si ya lo estaba.
+func consumirChallenge2FA(token string) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE tokens_usuario SET used_at = ?
+		WHERE token_hash = ? AND tipo = ? AND used_at IS NULL`, time.Now(), hashToken(token), token2FA)
+	if err != nil {
+		return false, err
+	}
+	aff, _ := res.RowsAffected()
+	return aff == 1, nil
+}
+
+func registrarRutasDosFactores(r *gin.Engine) {
+	// POST /2fa/enrolar (protegido) — opt-in
+	r.POST("/2fa/enrolar", AuthMiddleware(), func(c *gin.Context) {
+		u, err := buscarUsuario(c.GetInt("userID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		resp, err := iniciarEnrolamiento2FA(u.ID, u.Email)
+		if errors.Is(err, err2FAYaActivo) {
+			fallar(c, errores.DosFAActivo)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// POST /2fa/activar { "codigo": "123456" } (protegido)
+	r.POST("/2fa/activar", AuthMiddleware(), func(c *gin.Context) {
+		var body struct {
+			Codigo string `json:"codigo"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Codigo == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		ok, err := verificarSegundoFactor(c.GetInt("userID"), body.Codigo, "")
+		if errors.Is(err, err2FANoEnrolado) {
+			fallar(c, errores.DosFANoEnrolado)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.CodigoIncorrecto)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /2fa/desactivar { "codigo": "123456" } (protegido)
+	r.POST("/2fa/desactivar", AuthMiddleware(), func(c *gin.Context) {
+		var body struct {
+			Codigo string `json:"codigo"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Codigo == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		userID := c.GetInt("userID")
+		requerido, err := requiere2FA(userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if requerido {
+			fallar(c, errores.DosFAObligatorio)
+			return
+		}
+		ok, err := verificarSegundoFactor(userID, body.Codigo, "")
+		if err != nil && !errors.Is(err, err2FANoEnrolado) {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.CodigoIncorrecto)
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM usuario_2fa WHERE user_id = ?`, userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM codigos_recuperacion WHERE user_id = ?`, userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /login/2fa/enrolar { "challenge_token": "..." }
+	// Para usuarios a los que se les exige 2FA y todavía no lo tienen.
+	r.POST("/login/2fa/enrolar", func(c *gin.Context) {
+		var body struct {
+			ChallengeToken string `json:"challenge_token"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.ChallengeToken == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		userID, err := usuarioDeChallenge2FA(body.ChallengeToken)
+		if err != nil {
+			if errors.Is(err, errTokenInvalido) {
+				fallar(c, errores.ChallengeInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		u, err := buscarUsuario(userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		resp, err := iniciarEnrolamiento2FA(u.ID, u.Email)
+		if errors.Is(err, err2FAYaActivo) {
+			fallar(c, errores.DosFAActivo)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// POST /login/2fa { "challenge_token": "...", "codigo": "123456" | "codigo_recuperacion": "abcde-fghij" }
+	r.POST("/login/2fa", func(c *gin.Context) {
+		var body struct {
+			ChallengeToken     string `json:"challenge_token"`
+			Codigo             string `json:"codigo"`
+			CodigoRecuperacion string `json:"codigo_recuperacion"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.ChallengeToken == "" || (body.Codigo == "" && body.CodigoRecuperacion == "") {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		// además del máximo por challenge, límites por IP y por usuario: con la
+		// contraseña se pueden pedir challenges nuevos sin fin
+		claveIP := claveLimite("login2fa", "ip", c.ClientIP())
+		if !controlarLimite(c, claveIP, limite2FAIP) {
+			return
+		}
+		userID, err := intentarChallenge2FA(body.ChallengeToken)
+		if err != nil {
+			if errors.Is(err, errTokenInvalido) {
+				fallar(c, errores.ChallengeInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		claveUsuario := claveLimite("login2fa", "usuario", strconv.Itoa(userID))
+		if !controlarLimite(c, claveUsuario, limite2FAUsuario) {
+			if err := limitador.Devolver(claveIP); err != nil {
+				log.Println("❌ Error devolviendo intento:", err)
+			}
+			return
+		}
+
+		ok, err := verificarSegundoFactor(userID, body.Codigo, body.CodigoRecuperacion)
+		if err != nil && !errors.Is(err, err2FANoEnrolado) {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.CodigoIncorrecto)
+			return
+		}
+		if ok, err := consumirChallenge2FA(body.ChallengeToken); err != nil || !ok {
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			fallar(c, errores.ChallengeInvalido)
+			return
+		}
+
+		u, err := buscarUsuario(userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := limitador.Limpiar(claveUsuario); err != nil {
+			log.Println("❌ Error limpiando intentos:", err)
+		}
+		if err := limitador.Devolver(claveIP); err != nil {
+			log.Println("❌ Error devolviendo intento:", err)
+		}
+		limpiarIntentosLogin(u.Email, c.ClientIP())
+		sid, refresh, err := crearSesion(u.ID, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		resp, err := respuestaTokens(u, sid, refresh)
+		if err != nil {
+			fallar(c, errores.Interno)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,132 @@
+// Package errores define los errores de la API: cada uno tiene un código
+// estable (lo que deberían mirar los clientes), un status HTTP y un mensaje
+// traducido a es/en/pt. Los errores internos se loguean con un id de
+// correlación y al cliente solo le llega ese id.
+package errores
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type Codigo string
+
+const (
+	Interno            Codigo = "INTERNAL"
+	FormatoInvalido    Codigo = "INVALID_FORMAT"
+	IDInvalido         Codigo = "INVALID_ID"
+	DatosInvalidos     Codigo = "VALIDATION_FAILED"
+	DemasiadosIntentos Codigo = "TOO_MANY_ATTEMPTS"
+
+	// autenticación
+	TokenFaltante         Codigo = "TOKEN_MISSING"
+	TokenInvalido         Codigo = "TOKEN_INVALID"
+	TokenExpirado         Codigo = "TOKEN_EXPIRED"
+	SesionRevocada        Codigo = "SESSION_REVOKED"
+	NoAutenticado         Codigo = "UNAUTHENTICATED"
+	CredencialesInvalidas Codigo = "INVALID_CREDENTIALS"
+	RefreshInvalido       Codigo = "REFRESH_TOKEN_INVALID"
+	EnlaceInvalido        Codigo = "LINK_INVALID_OR_EXPIRED"
+	EmailNoVerificado     Codigo = "EMAIL_NOT_VERIFIED"
+	EmailYaVerificado     Codigo = "EMAIL_ALREADY_VERIFIED"
+	EmailEnUso            Codigo = "EMAIL_IN_USE"
+	PasswordIncorrecta    Codigo = "WRONG_PASSWORD"
+	CodigoIncorrecto      Codigo = "INVALID_2FA_CODE"
+	ChallengeInvalido     Codigo = "INVALID_2FA_CHALLENGE"
+	DosFAActivo           Codigo = "TWO_FACTOR_ALREADY_ACTIVE"
+	DosFANoEnrolado       Codigo = "TWO_FACTOR_NOT_ENROLLED"
+	DosFAObligatorio      Codigo = "TWO_FACTOR_REQUIRED"
+	APIKeyFaltante        Codigo = "API_KEY_MISSING"
+	APIKeyInvalida        Codigo = "API_KEY_INVALID"
+
+	// permisos
+	PermisoDenegado     Codigo = "FORBIDDEN"
+	NoDuenio            Codigo = "NOT_OWNER"
+	PermisoNoDelegable  Codigo = "PERMISSION_NOT_DELEGABLE"
+	DuenioNoPuedeStaff  Codigo = "OWNER_CANNOT_BE_STAFF"
+	RolInexistente      Codigo = "ROLE_NOT_FOUND"
+	RolNoAsignado       Codigo = "ROLE_NOT_ASSIGNED"
+	StaffNoEncontrado   Codigo = "STAFF_NOT_FOUND"
+	SinInvitacion       Codigo = "INVITATION_NOT_FOUND"
+	SoloVIP             Codigo = "VIP_REQUIRED"
+	ReservasSuspendidas Codigo = "RESERVATIONS_SUSPENDED"
+	IdiomaNoSoportado   Codigo = "LANGUAGE_NOT_SUPPORTED"
+	UsuarioNoEncontrado Codigo = "USER_NOT_FOUND"
+
+	// estacionamientos y lugares
+	EstacionamientoNoEncontrado Codigo = "PARKING_NOT_FOUND"
+	EstacionamientoConReservas  Codigo = "PARKING_HAS_ACTIVE_RESERVATIONS"
+	CuentaConReservas           Codigo = "ACCOUNT_HAS_ACTIVE_RESERVATIONS"
+	LugarNoEncontrado           Codigo = "SPOT_NOT_FOUND"
+	LugaresOcupados             Codigo = "SPOTS_OCCUPIED"
+	CapacidadInsuficiente       Codigo = "CAPACITY_BELOW_USAGE"
+	APIKeyNoEncontrada          Codigo = "API_KEY_NOT_FOUND"
+	ExcepcionNoEncontrada       Codigo = "SCHEDULE_EXCEPTION_NOT_FOUND"
+	EstacionamientoCerrado      Codigo = "PARKING_CLOSED"
+	TarifaNoEncontrada          Codigo = "TARIFF_NOT_FOUND"
+
+	// vehículos y reservas
+	VehiculoNoEncontrado      Codigo = "VEHICLE_NOT_FOUND"
+	VehiculoDuplicado         Codigo = "VEHICLE_PLATE_TAKEN"
+	VehiculoConReservas       Codigo = "VEHICLE_HAS_ACTIVE_RESERVATIONS"
+	VehiculoMuyAlto           Codigo = "VEHICLE_TOO_TALL"
+	SinLugarParaTipo          Codigo = "NO_SPOT_FOR_VEHICLE_TYPE"
+	PatenteInvalida           Codigo = "INVALID_PLATE"
+	ReservaActivaExistente    Codigo = "ACTIVE_RESERVATION_EXISTS"
+	ReservaNoEncontrada       Codigo = "RESERVATION_NOT_FOUND"
+	TransicionReservaInvalida Codigo = "RESERVATION_INVALID_TRANSITION"
+	LlegadaFueraDeFranja      Codigo = "CHECK_IN_OUTSIDE_WINDOW"
+	SinDisponibilidad         Codigo = "NO_AVAILABILITY"
+	LugarNoDisponible         Codigo = "SPOT_NOT_AVAILABLE"
+	LugaresReservados         Codigo = "SPOTS_RESERVED"
+)
+
+// Error es un error de la API. Detalles se agrega tal cual a la respuesta.
+type Error struct {
+	Codigo   Codigo
+	Status   int
+	Detalles map[string]interface{}
+	Causa    error
+}
+
+func (e *Error) Error() string {
+	if e.Causa != nil {
+		return fmt.Sprintf("%s: %v", e.Codigo, e.Causa)
+	}
+	return string(e.Codigo)
+}
+
+func (e *Error) Unwrap() error { return e.Causa }
+
+// Con agrega un dato a la respuesta (p.ej. los campos inválidos).
+func (e *Error) Con(clave string, valor interface{}) *Error {
+	if e.Detalles == nil {
+		e.Detalles = map[string]interface{}{}
+	}
+	e.Detalles[clave] = valor
+	return e
+}
+
+// Nuevo crea el error de codigo con su status por defecto.
+func Nuevo(codigo Codigo) *Error {
+	ent, ok := catalogo[codigo]
+	if !ok {
+		return &Error{Codigo: Interno, Status: http.StatusInternalServerError, Causa: fmt.Errorf("código desconocido %q", codigo)}
+	}
+	return &Error{Codigo: codigo, Status: ent.status}
+}
+
+// Envolver crea un error interno con causa; la causa solo va al log.
+func Envolver(err error) *Error {
+	return &Error{Codigo: Interno, Status: http.StatusInternalServerError, Causa: err}
+}
+
+// Desde devuelve err como *Error; cualquier otro error es interno.
+func Desde(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Envolver(err)
+}
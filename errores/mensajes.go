@@ -0,0 +1,123 @@
+package errores
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Idiomas en los que hay mensajes; el primero es el de por defecto.
+var Idiomas = []string{"es", "en", "pt"}
+
+type entrada struct {
+	status     int
+	es, en, pt string
+}
+
+var catalogo = map[Codigo]entrada{
+	Interno:            {http.StatusInternalServerError, "Error interno", "Internal error", "Erro interno"},
+	FormatoInvalido:    {http.StatusBadRequest, "Formato inválido", "Invalid format", "Formato inválido"},
+	IDInvalido:         {http.StatusBadRequest, "id inválido", "Invalid id", "id inválido"},
+	DatosInvalidos:     {http.StatusUnprocessableEntity, "Datos inválidos", "Invalid data", "Dados inválidos"},
+	DemasiadosIntentos: {http.StatusTooManyRequests, "Demasiados intentos, probá más tarde", "Too many attempts, try again later", "Muitas tentativas, tente mais tarde"},
+
+	TokenFaltante:         {http.StatusUnauthorized, "Token no enviado", "Missing token", "Token não enviado"},
+	TokenInvalido:         {http.StatusUnauthorized, "Token inválido", "Invalid token", "Token inválido"},
+	TokenExpirado:         {http.StatusUnauthorized, "Token expirado", "Token expired", "Token expirado"},
+	SesionRevocada:        {http.StatusUnauthorized, "Sesión revocada", "Session revoked", "Sessão revogada"},
+	NoAutenticado:         {http.StatusUnauthorized, "Sin usuario", "Not authenticated", "Não autenticado"},
+	CredencialesInvalidas: {http.StatusUnauthorized, "Credenciales inválidas", "Invalid credentials", "Credenciais inválidas"},
+	RefreshInvalido:       {http.StatusUnauthorized, "Refresh token inválido", "Invalid refresh token", "Refresh token inválido"},
+	EnlaceInvalido:        {http.StatusBadRequest, "Token inválido o vencido", "Invalid or expired token", "Token inválido ou expirado"},
+	EmailNoVerificado:     {http.StatusForbidden, "Email no verificado", "Email not verified", "Email não verificado"},
+	EmailYaVerificado:     {http.StatusConflict, "El email ya está verificado", "Email already verified", "O email já está verificado"},
+	EmailEnUso:            {http.StatusConflict, "El email ya está en uso", "Email already in use", "O email já está em uso"},
+	PasswordIncorrecta:    {http.StatusUnauthorized, "Contraseña incorrecta", "Wrong password", "Senha incorreta"},
+	CodigoIncorrecto:      {http.StatusUnauthorized, "Código inválido", "Invalid code", "Código inválido"},
+	ChallengeInvalido:     {http.StatusUnauthorized, "Challenge inválido o vencido", "Invalid or expired challenge", "Desafio inválido ou expirado"},
+	DosFAActivo:           {http.StatusConflict, "El 2FA ya está activo", "2FA is already active", "O 2FA já está ativo"},
+	DosFANoEnrolado:       {http.StatusBadRequest, "Primero hay que enrolar el 2FA", "2FA must be enrolled first", "É preciso cadastrar o 2FA primeiro"},
+	DosFAObligatorio:      {http.StatusForbidden, "El 2FA es obligatorio para dueños de estacionamientos", "2FA is required for parking owners", "O 2FA é obrigatório para donos de estacionamentos"},
+	APIKeyFaltante:        {http.StatusUnauthorized, "API key no enviada", "Missing API key", "API key não enviada"},
+	APIKeyInvalida:        {http.StatusUnauthorized, "API key inválida", "Invalid API key", "API key inválida"},
+
+	PermisoDenegado:     {http.StatusForbidden, "Permiso denegado", "Permission denied", "Permissão negada"},
+	NoDuenio:            {http.StatusForbidden, "No tenés permiso sobre este estacionamiento", "You have no permission on this parking", "Você não tem permissão neste estacionamento"},
+	PermisoNoDelegable:  {http.StatusBadRequest, "Permiso no delegable", "Permission cannot be delegated", "Permissão não delegável"},
+	DuenioNoPuedeStaff:  {http.StatusBadRequest, "El dueño no puede ser staff de su estacionamiento", "The owner cannot be staff of their own parking", "O dono não pode ser staff do seu estacionamento"},
+	RolInexistente:      {http.StatusBadRequest, "Rol inexistente", "Unknown role", "Papel inexistente"},
+	RolNoAsignado:       {http.StatusNotFound, "El usuario no tiene ese rol", "The user does not have that role", "O usuário não tem esse papel"},
+	StaffNoEncontrado:   {http.StatusNotFound, "Ese usuario no es staff del estacionamiento", "That user is not staff of the parking", "Esse usuário não é staff do estacionamento"},
+	SinInvitacion:       {http.StatusNotFound, "No tenés una invitación vigente para ese estacionamiento", "You have no valid invitation for that parking", "Você não tem um convite válido para esse estacionamento"},
+	SoloVIP:             {http.StatusForbidden, "Solo usuarios VIP pueden reservar", "Only VIP users can make reservations", "Somente usuários VIP podem reservar"},
+	ReservasSuspendidas: {http.StatusForbidden, "No podés reservar por un tiempo por reservas a las que no te presentaste", "You cannot make reservations for a while due to missed reservations", "Você não pode reservar por um tempo por reservas às quais não compareceu"},
+	IdiomaNoSoportado:   {http.StatusBadRequest, "Idioma no soportado", "Unsupported language", "Idioma não suportado"},
+	UsuarioNoEncontrado: {http.StatusNotFound, "Usuario no encontrado", "User not found", "Usuário não encontrado"},
+
+	EstacionamientoNoEncontrado: {http.StatusNotFound, "Estacionamiento no encontrado", "Parking not found", "Estacionamento não encontrado"},
+	EstacionamientoConReservas:  {http.StatusConflict, "El estacionamiento tiene reservas activas", "The parking has active reservations", "O estacionamento tem reservas ativas"},
+	CuentaConReservas:           {http.StatusConflict, "Tus estacionamientos tienen reservas activas; cancelalas antes de eliminar la cuenta", "Your parkings have active reservations; cancel them before deleting the account", "Seus estacionamentos têm reservas ativas; cancele-as antes de excluir a conta"},
+	LugarNoEncontrado:           {http.StatusNotFound, "Lugar inexistente", "Spot not found", "Vaga inexistente"},
+	LugaresOcupados:             {http.StatusConflict, "Hay lugares ocupados entre los que se quieren quitar", "Some of the spots to remove are occupied", "Há vagas ocupadas entre as que se quer remover"},
+	CapacidadInsuficiente:       {http.StatusConflict, "La nueva capacidad no alcanza para los lugares ocupados y las reservas activas", "The new capacity is below occupied spots plus active reservations", "A nova capacidade não comporta as vagas ocupadas e as reservas ativas"},
+	APIKeyNoEncontrada:          {http.StatusNotFound, "API key inexistente o ya revocada", "API key not found or already revoked", "API key inexistente ou já revogada"},
+	ExcepcionNoEncontrada:       {http.StatusNotFound, "No hay una excepción de horario para esa fecha", "There is no schedule exception for that date", "Não há uma exceção de horário para essa data"},
+	EstacionamientoCerrado:      {http.StatusConflict, "El estacionamiento está cerrado en ese horario", "The parking is closed at that time", "O estacionamento está fechado nesse horário"},
+	TarifaNoEncontrada:          {http.StatusNotFound, "El estacionamiento no tiene tarifa cargada", "The parking has no tariff set", "O estacionamento não tem tarifa cadastrada"},
+
+	VehiculoNoEncontrado:      {http.StatusNotFound, "Vehículo inexistente", "Vehicle not found", "Veículo inexistente"},
+	VehiculoDuplicado:         {http.StatusConflict, "Ya tenés un vehículo con esa patente", "You already have a vehicle with that plate", "Você já tem um veículo com essa placa"},
+	VehiculoConReservas:       {http.StatusConflict, "El vehículo tiene reservas activas", "The vehicle has active reservations", "O veículo tem reservas ativas"},
+	VehiculoMuyAlto:           {http.StatusConflict, "El vehículo supera la altura máxima del estacionamiento", "The vehicle exceeds the parking's maximum height", "O veículo excede a altura máxima do estacionamento"},
+	SinLugarParaTipo:          {http.StatusConflict, "No hay lugares para este tipo de vehículo", "There are no spots for this vehicle type", "Não há vagas para este tipo de veículo"},
+	PatenteInvalida:           {http.StatusBadRequest, "Patente inválida", "Invalid license plate", "Placa inválida"},
+	ReservaActivaExistente:    {http.StatusConflict, "Ya tenés una reserva activa en este estacionamiento", "You already have an active reservation at this parking", "Você já tem uma reserva ativa neste estacionamento"},
+	ReservaNoEncontrada:       {http.StatusNotFound, "No tenés una reserva activa para cancelar", "You have no active reservation to cancel", "Você não tem uma reserva ativa para cancelar"},
+	TransicionReservaInvalida: {http.StatusConflict, "La reserva ya no se puede modificar en su estado actual", "The reservation can no longer be changed in its current state", "A reserva não pode mais ser alterada no estado atual"},
+	LlegadaFueraDeFranja:      {http.StatusConflict, "La llegada solo se puede registrar durante la franja de la reserva", "Arrival can only be recorded during the reservation's time slot", "A chegada só pode ser registrada durante o horário da reserva"},
+	SinDisponibilidad:         {http.StatusConflict, "No hay lugares disponibles en ese horario", "There are no spots available at that time", "Não há vagas disponíveis nesse horário"},
+	LugarNoDisponible:         {http.StatusConflict, "Ese lugar está ocupado o reservado en ese horario", "That spot is occupied or reserved at that time", "Essa vaga está ocupada ou reservada nesse horário"},
+	LugaresReservados:         {http.StatusConflict, "Hay reservas en lugares que se quieren quitar", "Some of the spots to remove have reservations", "Há reservas em vagas que se quer remover"},
+}
+
+// Mensaje devuelve el texto de codigo en idioma (o en español si no hay).
+func Mensaje(codigo Codigo, idioma string) string {
+	e, ok := catalogo[codigo]
+	if !ok {
+		e = catalogo[Interno]
+	}
+	switch idioma {
+	case "en":
+		return e.en
+	case "pt":
+		return e.pt
+	}
+	return e.es
+}
+
+// IdiomaDe elige el idioma soportado con mayor q de un Accept-Language
+// ("pt-BR,pt;q=0.9,en;q=0.8"). Sin coincidencias devuelve "es".
+func IdiomaDe(acceptLanguage string) string {
+	mejor, mejorQ := Idiomas[0], 0.0
+	for _, parte := range strings.Split(acceptLanguage, ",") {
+		campos := strings.Split(strings.TrimSpace(parte), ";")
+		tag := strings.ToLower(strings.TrimSpace(campos[0]))
+		if i := strings.IndexByte(tag, '-'); i >= 0 {
+			tag = tag[:i]
+		}
+		q := 1.0
+		for _, p := range campos[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		for _, idioma := range Idiomas {
+			if tag == idioma && q > mejorQ {
+				mejor, mejorQ = idioma, q
+			}
+		}
+	}
+	return mejor
+}
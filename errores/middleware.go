@@ -0,0 +1,64 @@
+package errores
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const HeaderRequestID = "X-Request-ID"
+
+var reRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func nuevoRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Responder registra err en el contexto y corta la cadena; Middleware arma
+// la respuesta.
+func Responder(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// Middleware asigna un id de correlación a cada request (o respeta el
+// X-Request-ID entrante) y, si algún handler registró un error sin
+// responder, contesta con el sobre estándar:
+//
+//	{"error": "<mensaje traducido>", "codigo": "PARKING_NOT_FOUND", "request_id": "..."}
+//
+// Los errores internos se loguean con su causa y al cliente solo le llega
+// el id para buscarlo.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !reRequestID.MatchString(id) {
+			id = nuevoRequestID()
+		}
+		c.Set("requestID", id)
+		c.Header(HeaderRequestID, id)
+
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		e := Desde(c.Errors.Last().Err)
+		if e.Codigo == Interno {
+			log.Printf("❌ [%s] %s %s: %v", id, c.Request.Method, c.FullPath(), e.Causa)
+		}
+		body := gin.H{}
+		for k, v := range e.Detalles {
+			body[k] = v
+		}
+		body["error"] = Mensaje(e.Codigo, IdiomaDe(c.GetHeader("Accept-Language")))
+		body["codigo"] = e.Codigo
+		body["request_id"] = id
+		c.JSON(e.Status, body)
+	}
+}
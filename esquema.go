@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// ----------- ESQUEMA -------------
+// Tablas que agrega el backend sobre el esquema base (usuarios, estacionamientos,
+// lugares, dias_atencion, reservas). Se crean al arrancar si no existen.
+var esquema = []string{
+	`CREATE TABLE IF NOT EXISTS sesiones (
+		id           VARCHAR(64)  NOT NULL PRIMARY KEY,
+		user_id      INT          NOT NULL,
+		refresh_hash CHAR(64)     NOT NULL,
+		user_agent   VARCHAR(255) NULL,
+		ip           VARCHAR(64)  NULL,
+		created_at   DATETIME     NOT NULL,
+		last_used_at DATETIME     NULL,
+		expires_at   DATETIME     NOT NULL,
+		revoked_at   DATETIME     NULL,
+		INDEX idx_sesiones_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS jti_revocados (
+		jti        VARCHAR(64) NOT NULL PRIMARY KEY,
+		expires_at DATETIME    NOT NULL,
+		INDEX idx_jti_revocados_exp (expires_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS roles (
+		nombre      VARCHAR(32)  NOT NULL PRIMARY KEY,
+		descripcion VARCHAR(255) NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS rol_permisos (
+		rol     VARCHAR(32) NOT NULL,
+		permiso VARCHAR(64) NOT NULL,
+		PRIMARY KEY (rol, permiso)
+	)`,
+	`CREATE TABLE IF NOT EXISTS usuario_roles (
+		user_id            INT         NOT NULL,
+		rol                VARCHAR(32) NOT NULL,
+		estacionamiento_id INT         NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, rol, estacionamiento_id),
+		INDEX idx_usuario_roles_est (estacionamiento_id)
+	)`,
+	`INSERT IGNORE INTO roles (nombre, descripcion) VALUES
+		('driver', 'Conductor: busca y reserva lugares'),
+		('owner',  'Dueño de estacionamiento'),
+		('staff',  'Empleado asignado a un estacionamiento'),
+		('admin',  'Administrador de la plataforma')`,
+	`INSERT IGNORE INTO rol_permisos (rol, permiso) VALUES
+		('driver', 'reservas.crear'),
+		('owner',  'reservas.ver'),
+		('owner',  'reservas.gestionar'),
+		('owner',  'lugares.estado'),
+		('owner',  'lugares.editar'),
+		('owner',  'estacionamientos.editar'),
+		('owner',  'estacionamientos.eliminar'),
+		('owner',  'staff.gestionar'),
+		('owner',  'dispositivos.gestionar'),
+		('admin',  '*')`,
+	`CREATE TABLE IF NOT EXISTS estacionamiento_staff (
+		estacionamiento_id INT          NOT NULL,
+		user_id            INT          NOT NULL,
+		permisos           VARCHAR(255) NOT NULL,
+		invitado_por       INT          NOT NULL,
+		created_at         TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (estacionamiento_id, user_id),
+		INDEX idx_estacionamiento_staff_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS staff_invitaciones (
+		estacionamiento_id INT          NOT NULL,
+		email              VARCHAR(255) NOT NULL,
+		permisos           VARCHAR(255) NOT NULL,
+		invitado_por       INT          NOT NULL,
+		created_at         DATETIME     NOT NULL,
+		PRIMARY KEY (estacionamiento_id, email),
+		INDEX idx_staff_invitaciones_email (email)
+	)`,
+	`CREATE TABLE IF NOT EXISTS tokens_usuario (
+		token_hash CHAR(64)     NOT NULL PRIMARY KEY,
+		user_id    INT          NOT NULL,
+		tipo       VARCHAR(16)  NOT NULL,
+		email      VARCHAR(255) NULL,
+		created_at DATETIME     NOT NULL,
+		expires_at DATETIME     NOT NULL,
+		used_at    DATETIME     NULL,
+		INDEX idx_tokens_usuario_user (user_id, tipo)
+	)`,
+	`CREATE TABLE IF NOT EXISTS usuario_2fa (
+		user_id     INT         NOT NULL PRIMARY KEY,
+		secreto     VARCHAR(64) NOT NULL,
+		activo      TINYINT(1)  NOT NULL DEFAULT 0,
+		ultimo_paso BIGINT      NOT NULL DEFAULT 0,
+		created_at  DATETIME    NOT NULL,
+		activado_at DATETIME    NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS codigos_recuperacion (
+		user_id   INT      NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at   DATETIME NULL,
+		PRIMARY KEY (user_id, code_hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS intentos_auth (
+		id    BIGINT       NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		clave VARCHAR(191) NOT NULL,
+		ts    DATETIME(3)  NOT NULL,
+		INDEX idx_intentos_auth_clave (clave, ts),
+		INDEX idx_intentos_auth_ts (ts)
+	)`,
+	`CREATE TABLE IF NOT EXISTS intentos_auth_claves (
+		clave          VARCHAR(191) NOT NULL PRIMARY KEY,
+		actualizado_at DATETIME(3)  NOT NULL,
+		INDEX idx_intentos_auth_claves_act (actualizado_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS jwt_llaves (
+		kid         VARCHAR(64) NOT NULL PRIMARY KEY,
+		alg         VARCHAR(16) NOT NULL,
+		private_pem TEXT        NOT NULL,
+		created_at  DATETIME    NOT NULL,
+		retirar_at  DATETIME    NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id                 INT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		estacionamiento_id INT          NOT NULL,
+		nombre             VARCHAR(100) NOT NULL,
+		prefijo            VARCHAR(16)  NOT NULL,
+		key_hash           CHAR(64)     NOT NULL,
+		created_by         INT          NOT NULL,
+		created_at         DATETIME     NOT NULL,
+		last_used_at       DATETIME     NULL,
+		revoked_at         DATETIME     NULL,
+		UNIQUE KEY uq_api_keys_hash (key_hash),
+		INDEX idx_api_keys_est (estacionamiento_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS eventos_acceso (
+		id                 BIGINT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		estacionamiento_id INT         NOT NULL,
+		api_key_id         INT         NOT NULL,
+		tipo               VARCHAR(16) NOT NULL,
+		numero             INT         NULL,
+		patente            VARCHAR(16) NULL,
+		ocurrido_at        DATETIME    NOT NULL,
+		INDEX idx_eventos_acceso_est (estacionamiento_id, ocurrido_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS vehiculos (
+		id      INT         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		user_id INT         NOT NULL,
+		patente VARCHAR(16) NOT NULL,
+		UNIQUE KEY uq_vehiculos_user_patente (user_id, patente)
+	)`,
+	`CREATE TABLE IF NOT EXISTS excepciones_horario (
+		estacionamiento_id INT          NOT NULL,
+		fecha              DATE         NOT NULL,
+		cerrado            TINYINT(1)   NOT NULL DEFAULT 1,
+		desde              VARCHAR(8)   NULL,
+		hasta              VARCHAR(8)   NULL,
+		motivo             VARCHAR(100) NULL,
+		PRIMARY KEY (estacionamiento_id, fecha)
+	)`,
+	`CREATE TABLE IF NOT EXISTS tarifas (
+		id                 INT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		estacionamiento_id INT      NOT NULL,
+		version            INT      NOT NULL,
+		reglas             TEXT     NOT NULL,
+		vigente_desde      DATETIME NOT NULL,
+		created_by         INT      NOT NULL,
+		created_at         DATETIME NOT NULL,
+		UNIQUE KEY uq_tarifas_est_version (estacionamiento_id, version),
+		INDEX idx_tarifas_vigencia (estacionamiento_id, vigente_desde)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reservas_historial (
+		id              INT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		reserva_id      INT          NOT NULL,
+		estado_anterior VARCHAR(20)  NULL,
+		estado          VARCHAR(20)  NOT NULL,
+		actor_id        INT          NULL,
+		motivo          VARCHAR(255) NULL,
+		created_at      DATETIME     NOT NULL,
+		INDEX idx_reservas_historial_reserva (reserva_id, id)
+	)`,
+}
+
+// columnas agregadas a tablas existentes. MySQL no tiene ADD COLUMN IF NOT
+// EXISTS, así que se consulta information_schema antes de alterar.
+var columnas = []struct {
+	tabla, columna, definicion string
+	despues                    []string // se ejecutan solo al crear la columna
+}{
+	{
+		tabla: "usuarios", columna: "email_verificado", definicion: "TINYINT(1) NOT NULL DEFAULT 1",
+		// los usuarios previos quedan verificados; los nuevos arrancan sin verificar
+		despues: []string{`ALTER TABLE usuarios ALTER COLUMN email_verificado SET DEFAULT 0`},
+	},
+	{tabla: "tokens_usuario", columna: "intentos", definicion: "INT NOT NULL DEFAULT 0"},
+	{tabla: "usuarios", columna: "nombre", definicion: "VARCHAR(100) NULL"},
+	{tabla: "usuarios", columna: "telefono", definicion: "VARCHAR(32) NULL"},
+	{tabla: "usuarios", columna: "idioma", definicion: "VARCHAR(5) NOT NULL DEFAULT 'es'"},
+	{tabla: "usuarios", columna: "eliminado_at", definicion: "DATETIME NULL"},
+	{tabla: "vehiculos", columna: "tipo", definicion: "VARCHAR(16) NOT NULL DEFAULT 'auto'"},
+	{tabla: "vehiculos", columna: "altura_m", definicion: "DECIMAL(4,2) NULL"},
+	{tabla: "vehiculos", columna: "electrico", definicion: "TINYINT(1) NOT NULL DEFAULT 0"},
+	{tabla: "vehiculos", columna: "alias", definicion: "VARCHAR(50) NULL"},
+	{tabla: "lugares", columna: "tipo", definicion: "VARCHAR(16) NULL"},
+	{tabla: "reservas", columna: "vehiculo_id", definicion: "INT NULL"},
+	{tabla: "eventos_acceso", columna: "vehiculo_id", definicion: "INT NULL"},
+	{tabla: "estacionamientos", columna: "eliminado_at", definicion: "DATETIME NULL"},
+	{
+		// punto derivado de latitud/longitud para el índice espacial (ver geo.go)
+		tabla: "estacionamientos", columna: "ubicacion",
+		definicion: "POINT AS (POINT(longitud, latitud)) STORED NOT NULL SRID 0",
+		despues:    []string{`ALTER TABLE estacionamientos ADD SPATIAL INDEX idx_estacionamientos_ubicacion (ubicacion)`},
+	},
+	// las reservas se referencian por id desde la API (no-op si ya lo tiene)
+	{tabla: "reservas", columna: "id", definicion: "INT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST"},
+	{tabla: "reservas", columna: "desde", definicion: "DATETIME NULL"},
+	{
+		tabla: "reservas", columna: "hasta", definicion: "DATETIME NULL",
+		despues: []string{`ALTER TABLE reservas ADD INDEX idx_reservas_franja (estacionamiento_id, status, desde, hasta)`},
+	},
+	{tabla: "reservas", columna: "numero", definicion: "INT NULL"},
+	{tabla: "reservas", columna: "created_at", definicion: "DATETIME NULL"},
+	{tabla: "reservas", columna: "llegada_at", definicion: "DATETIME NULL"},
+	{tabla: "reservas", columna: "finalizada_at", definicion: "DATETIME NULL"},
+	{tabla: "reservas", columna: "motivo_fin", definicion: "VARCHAR(32) NULL"},
+	{tabla: "usuarios", columna: "reservas_suspendidas_hasta", definicion: "DATETIME NULL"},
+	{
+		// inicio de la franja solo mientras está activa: el índice único impide
+		// dos reservas activas iguales del mismo usuario (p.ej. doble envío) y
+		// deja repetir la franja después de cancelar
+		tabla: "reservas", columna: "desde_activa",
+		definicion: "DATETIME AS (IF(status = 1, desde, NULL)) VIRTUAL",
+		despues:    []string{`ALTER TABLE reservas ADD UNIQUE INDEX uq_reservas_usuario_franja (user_id, estacionamiento_id, desde_activa)`},
+	},
+	{
+		// desde cuándo firma cada llave JWT; las previas ya firmaban al crearse
+		tabla: "jwt_llaves", columna: "activa_desde", definicion: "DATETIME NULL",
+		despues: []string{
+			`UPDATE jwt_llaves SET activa_desde = created_at`,
+			`ALTER TABLE jwt_llaves MODIFY activa_desde DATETIME NOT NULL`,
+		},
+	},
+	{tabla: "reservas", columna: "confirmada_at", definicion: "DATETIME NULL"},
+	{
+		// estado de la reserva (ver estados_reserva.go); las previas se mapean
+		// desde status/llegada_at/motivo_fin y motivo_fin pasa a texto libre
+		tabla: "reservas", columna: "estado", definicion: "VARCHAR(20) NOT NULL DEFAULT 'confirmed'",
+		despues: []string{
+			`UPDATE reservas SET estado = CASE
+				WHEN status = 1 AND llegada_at IS NOT NULL THEN 'checked_in'
+				WHEN status = 1 THEN 'confirmed'
+				WHEN motivo_fin = 'no_show' THEN 'no_show'
+				WHEN motivo_fin = 'finalizada' THEN 'completed'
+				ELSE 'canceled_by_user' END`,
+			`UPDATE reservas SET confirmada_at = created_at`,
+			`UPDATE reservas SET motivo_fin = NULL WHERE motivo_fin IN ('no_show', 'finalizada')`,
+			`ALTER TABLE reservas MODIFY motivo_fin VARCHAR(255) NULL`,
+			`ALTER TABLE reservas ADD INDEX idx_reservas_estado (estado, desde)`,
+		},
+	},
+}
+
+// migraciones corren en cada arranque después de columnas, así que tienen
+// que ser idempotentes.
+var migraciones = []string{
+	// emails guardados antes de normalizarlos (ver normalizarEmail); si ya
+	// hay otra cuenta con la forma normalizada la fila queda como estaba
+	`UPDATE IGNORE usuarios SET email = LOWER(TRIM(email)) WHERE BINARY email <> LOWER(TRIM(email))`,
+	// las reservas viejas sin franja quedaron activas (status = 1, mapeadas a
+	// confirmed); son historial y no ocupan cupo, así que se cierran
+	`UPDATE reservas SET estado = 'completed', status = 0, finalizada_at = IFNULL(finalizada_at, NOW())
+	 WHERE estado IN ('pending', 'confirmed', 'checked_in') AND desde IS NULL`,
+}
+
+func asegurarEsquema() {
+	for _, q := range esquema {
+		if _, err := db.Exec(q); err != nil {
+			log.Fatal("❌ Error creando esquema: ", err)
+		}
+	}
+	for _, col := range columnas {
+		var n int
+		if err := db.QueryRow(`
+			SELECT COUNT(1) FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`,
+			col.tabla, col.columna,
+		).Scan(&n); err != nil {
+			log.Fatal("❌ Error leyendo esquema: ", err)
+		}
+		if n > 0 {
+			continue
+		}
+		stmts := append([]string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.tabla, col.columna, col.definicion)}, col.despues...)
+		for _, q := range stmts {
+			if _, err := db.Exec(q); err != nil {
+				log.Fatal("❌ Error agregando columna ", col.tabla, ".", col.columna, ": ", err)
+			}
+		}
+	}
+	for _, q := range migraciones {
+		if _, err := db.Exec(q); err != nil {
+			log.Fatal("❌ Error migrando esquema: ", err)
+		}
+	}
+}
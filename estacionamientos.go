@@ -0,0 +1,451 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- EDICIÓN Y BAJA DE ESTACIONAMIENTOS -------------
+// PATCH cambia solo los campos enviados (null borra los opcionales) y PUT
+// reemplaza el estacionamiento entero. "dias" siempre reemplaza el horario
+// completo. DELETE es una baja lógica (eliminado_at): deja de listarse y de
+// aceptar reservas, pero las reservas viejas quedan como historial.
+
+var seguridadPermitida = map[string]bool{"camaras": true, "vigilante": true}
+
+// normalizarSeguridad descarta valores desconocidos y devuelve el SET de MySQL.
+func normalizarSeguridad(in []string) string {
+	out := make([]string, 0, len(in))
+	for _, v := range in {
+		if seguridadPermitida[v] && !contiene(out, v) {
+			out = append(out, v)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// estacionamientoActivo indica si el estacionamiento existe y no fue dado de baja.
+func estacionamientoActivo(id int) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(1) FROM estacionamientos WHERE id = ? AND eliminado_at IS NULL`, id).Scan(&n)
+	return n > 0, err
+}
+
+// máximo de lugares por estacionamiento (se crean todas las filas de una)
+const maxLugares = 2000
+
+// errorCampo es un error de guardado atribuible a un campo del cuerpo.
+type errorCampo struct {
+	Campo string
+	Err   error
+}
+
+func (e *errorCampo) Error() string { return e.Campo + ": " + e.Err.Error() }
+func (e *errorCampo) Unwrap() error { return e.Err }
+
+// normalizarDias guarda los días sin tildes y las horas como HH:MM.
+func normalizarDias(dias []DiaAtencion) []DiaAtencion {
+	out := make([]DiaAtencion, len(dias))
+	for i, d := range dias {
+		out[i] = DiaAtencion{Dia: normalizarDia(d.Dia), Desde: horaHHMM(d.Desde), Hasta: horaHHMM(d.Hasta)}
+	}
+	return out
+}
+
+// insertarLugares crea los lugares desde..hasta (inclusive) libres, en tandas.
+func insertarLugares(tx *sql.Tx, estID, desde, hasta int) error {
+	const tanda = 500
+	for ini := desde; ini <= hasta; ini += tanda {
+		fin := ini + tanda - 1
+		if fin > hasta {
+			fin = hasta
+		}
+		vals := make([]string, 0, fin-ini+1)
+		args := make([]interface{}, 0, 2*(fin-ini+1))
+		for n := ini; n <= fin; n++ {
+			vals = append(vals, "(?, ?, 0)")
+			args = append(args, estID, n)
+		}
+		if _, err := tx.Exec(`INSERT INTO lugares (estacionamiento_id, numero, ocupado) VALUES `+strings.Join(vals, ", "), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// crearEstacionamiento da de alta el estacionamiento, su horario y sus
+// lugares en una sola transacción: si algo falla no queda nada a medias.
+func crearEstacionamiento(duenioID int, in EstacionamientoNuevo) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO estacionamientos
+		  (duenio_id, nombre, cantidad, latitud, longitud,
+		   precio_por_hora, techado, seguridad, banos, altura_max_m)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		duenioID, strings.TrimSpace(in.Nombre), in.Cantidad, in.Latitud, in.Longitud,
+		in.PrecioPorHora, in.Techado, normalizarSeguridad(in.Seguridad), in.Banos != nil && *in.Banos, in.AlturaMaxM,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, d := range normalizarDias(in.Dias) {
+		if _, err := tx.Exec(`
+			INSERT INTO dias_atencion (estacionamiento_id, dia, desde, hasta)
+			VALUES (?, ?, ?, ?)`, id, d.Dia, d.Desde, d.Hasta); err != nil {
+			return 0, &errorCampo{Campo: fmt.Sprintf("dias[%d]", i), Err: err}
+		}
+	}
+	if err := insertarLugares(tx, int(id), 1, in.Cantidad); err != nil {
+		return 0, &errorCampo{Campo: "cantidad", Err: err}
+	}
+	return id, tx.Commit()
+}
+
+var (
+	errLugaresOcupados   = errors.New("hay lugares ocupados entre los que se quieren quitar")
+	errCapacidadReservas = errors.New("la nueva capacidad no alcanza para los lugares ocupados y las reservas activas")
+	errLugaresReservados = errors.New("hay reservas en lugares que se quieren quitar")
+)
+
+// cambiarCapacidad deja exactamente los lugares 1..nueva: agrega los que
+// faltan (libres) y borra los sobrantes si están libres. Los lugares que se
+// mantienen conservan su estado. También actualiza estacionamientos.cantidad.
+func cambiarCapacidad(tx *sql.Tx, estID, nueva int) error {
+	if nueva <= 0 || nueva > maxLugares {
+		return &errorCampo{Campo: "cantidad", Err: fmt.Errorf("debe estar entre 1 y %d", maxLugares)}
+	}
+	// serializa cambios concurrentes sobre el mismo estacionamiento
+	var actual int
+	if err := tx.QueryRow(`SELECT cantidad FROM estacionamientos WHERE id = ? FOR UPDATE`, estID).Scan(&actual); err != nil {
+		return err
+	}
+
+	var maxNumero, ocupadosFuera, ocupadosDentro int
+	if err := tx.QueryRow(`
+		SELECT IFNULL(MAX(numero), 0),
+		       IFNULL(SUM(numero > ? AND ocupado = 1), 0),
+		       IFNULL(SUM(numero <= ? AND ocupado = 1), 0)
+		FROM lugares WHERE estacionamiento_id = ?`, nueva, nueva, estID,
+	).Scan(&maxNumero, &ocupadosFuera, &ocupadosDentro); err != nil {
+		return err
+	}
+	if ocupadosFuera > 0 {
+		return errLugaresOcupados
+	}
+	// reservas que todavía no terminaron: ninguna en un lugar que se quita,
+	// ni más simultáneas que la nueva capacidad (ahora, sumadas a los ocupados)
+	ahora := time.Now()
+	var reservadosFuera, reservadosAhora int
+	if err := tx.QueryRow(`
+		SELECT IFNULL(SUM(numero > ?), 0), IFNULL(SUM(desde <= ?), 0)
+		FROM reservas WHERE estacionamiento_id = ? AND status = 1 AND hasta > ?`,
+		nueva, ahora, estID, ahora).Scan(&reservadosFuera, &reservadosAhora); err != nil {
+		return err
+	}
+	if reservadosFuera > 0 {
+		return errLugaresReservados
+	}
+	pico, err := picoReservas(tx, estID, ahora, ahora.Add(reservaAnticipacionMaxima+reservaDuracionMaxima))
+	if err != nil {
+		return err
+	}
+	if ocupadosDentro+reservadosAhora > nueva || pico > nueva {
+		return errCapacidadReservas
+	}
+
+	if maxNumero > nueva {
+		if _, err := tx.Exec(`DELETE FROM lugares WHERE estacionamiento_id = ? AND numero > ?`, estID, nueva); err != nil {
+			return err
+		}
+	}
+	if maxNumero < nueva {
+		if err := insertarLugares(tx, estID, maxNumero+1, nueva); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE estacionamientos SET cantidad = ? WHERE id = ?`, nueva, estID)
+	return err
+}
+
+// errorCapacidadJSON responde los errores de cambiarCapacidad; devuelve false
+// si err no es uno de ellos.
+func errorCapacidadJSON(c *gin.Context, err error) bool {
+	var ec *errorCampo
+	switch {
+	case errors.Is(err, errLugaresOcupados):
+		fallar(c, errores.LugaresOcupados)
+	case errors.Is(err, errCapacidadReservas):
+		fallar(c, errores.CapacidadInsuficiente)
+	case errors.Is(err, errLugaresReservados):
+		fallar(c, errores.LugaresReservados)
+	case errors.As(err, &ec) && ec.Campo == "cantidad":
+		responderInvalidos(c, []errorValidacion{{Campo: ec.Campo, Motivo: ec.Err.Error()}})
+	default:
+		return false
+	}
+	return true
+}
+
+func reemplazarDias(tx *sql.Tx, estID int, dias []DiaAtencion) error {
+	if _, err := tx.Exec(`DELETE FROM dias_atencion WHERE estacionamiento_id = ?`, estID); err != nil {
+		return err
+	}
+	for _, d := range normalizarDias(dias) {
+		if _, err := tx.Exec(`
+			INSERT INTO dias_atencion (estacionamiento_id, dia, desde, hasta)
+			VALUES (?, ?, ?, ?)`, estID, d.Dia, d.Desde, d.Hasta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CambiosEstacionamiento es el cuerpo de PATCH /estacionamientos/:id: los
+// campos de EstacionamientoNuevo con las mismas reglas, todos opcionales. Un
+// null borra los opcionales y en los obligatorios es inválido.
+type CambiosEstacionamiento struct {
+	Nombre        *string        `json:"nombre" binding:"omitempty,novacio,max=100"`
+	Cantidad      *int           `json:"cantidad" binding:"omitempty,min=1,max=2000"` // maxLugares
+	Latitud       *float64       `json:"latitud" binding:"omitempty,min=-90,max=90"`
+	Longitud      *float64       `json:"longitud" binding:"omitempty,min=-180,max=180"`
+	PrecioPorHora *float64       `json:"precio_por_hora" binding:"omitempty,min=0"`
+	Techado       *string        `json:"techado" binding:"omitempty,oneof=si no parcial"`
+	Seguridad     []string       `json:"seguridad" binding:"omitempty,dive,oneof=camaras vigilante"`
+	Banos         *bool          `json:"banos"`
+	AlturaMaxM    *float64       `json:"altura_max_m" binding:"omitempty,gt=0,max=10"`
+	Dias          *[]DiaAtencion `json:"dias" binding:"omitempty,max=21,dive"`
+}
+
+// cambiosEstacionamiento junta los SET del UPDATE y, si vino, el horario nuevo.
+type cambiosEstacionamiento struct {
+	sets     []string
+	args     []interface{}
+	dias     *[]DiaAtencion
+	cantidad *int
+}
+
+func (ce *cambiosEstacionamiento) set(col string, v interface{}) {
+	ce.sets = append(ce.sets, col+" = ?")
+	ce.args = append(ce.args, v)
+}
+
+// parsearCambiosEstacionamiento valida el cuerpo con los tags de
+// CambiosEstacionamiento y traduce a columnas solo los campos presentes en
+// el JSON. Devuelve los campos inválidos, si hay.
+func parsearCambiosEstacionamiento(campos map[string]json.RawMessage) (cambiosEstacionamiento, []errorValidacion) {
+	var (
+		ce cambiosEstacionamiento
+		in CambiosEstacionamiento
+	)
+	cuerpo, _ := json.Marshal(campos)
+	if err := json.Unmarshal(cuerpo, &in); err != nil {
+		campo := "cuerpo"
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			campo = te.Field
+		}
+		return ce, []errorValidacion{{Campo: campo, Motivo: "tipo inválido"}}
+	}
+	errs := validarStruct(in)
+	for k, v := range map[string]bool{
+		"nombre": in.Nombre == nil, "latitud": in.Latitud == nil,
+		"longitud": in.Longitud == nil, "cantidad": in.Cantidad == nil,
+	} {
+		if _, ok := campos[k]; ok && v {
+			errs = append(errs, errorValidacion{Campo: k, Motivo: "obligatorio"})
+		}
+	}
+	if len(errs) > 0 {
+		return ce, errs
+	}
+
+	presente := func(k string) bool {
+		_, ok := campos[k]
+		return ok
+	}
+	if presente("nombre") {
+		ce.set("nombre", strings.TrimSpace(*in.Nombre))
+	}
+	if presente("latitud") {
+		ce.set("latitud", *in.Latitud)
+	}
+	if presente("longitud") {
+		ce.set("longitud", *in.Longitud)
+	}
+	if presente("precio_por_hora") {
+		ce.set("precio_por_hora", in.PrecioPorHora)
+	}
+	if presente("altura_max_m") {
+		ce.set("altura_max_m", in.AlturaMaxM)
+	}
+	if presente("techado") {
+		ce.set("techado", in.Techado)
+	}
+	if presente("seguridad") {
+		ce.set("seguridad", normalizarSeguridad(in.Seguridad))
+	}
+	if presente("banos") {
+		ce.set("banos", in.Banos != nil && *in.Banos)
+	}
+	if presente("dias") {
+		dias := []DiaAtencion{}
+		if in.Dias != nil {
+			dias = *in.Dias
+		}
+		ce.dias = &dias
+	}
+	ce.cantidad = in.Cantidad
+	return ce, nil
+}
+
+// aplicarCambiosEstacionamiento guarda los cambios y el horario en una transacción.
+func aplicarCambiosEstacionamiento(estID int, ce cambiosEstacionamiento) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(ce.sets) > 0 {
+		if _, err := tx.Exec(`UPDATE estacionamientos SET `+strings.Join(ce.sets, ", ")+` WHERE id = ?`,
+			append(ce.args, estID)...); err != nil {
+			return err
+		}
+	}
+	if ce.dias != nil {
+		if err := reemplazarDias(tx, estID, *ce.dias); err != nil {
+			return err
+		}
+	}
+	if ce.cantidad != nil {
+		if err := cambiarCapacidad(tx, estID, *ce.cantidad); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func registrarRutasEstacionamientos(r *gin.Engine) {
+	editar := RequirePermissionEn(estIDParam("id"), permEstEditar)
+
+	guardar := func(c *gin.Context, campos map[string]json.RawMessage) {
+		ce, errs := parsearCambiosEstacionamiento(campos)
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+		if err := aplicarCambiosEstacionamiento(c.GetInt("estacionamientoID"), ce); err != nil {
+			if !errorCapacidadJSON(c, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": c.GetInt("estacionamientoID")})
+	}
+
+	// PATCH /estacionamientos/:id { "nombre"?, "precio_por_hora"?, ..., "dias"? }
+	r.PATCH("/estacionamientos/:id", AuthMiddleware(), editar, func(c *gin.Context) {
+		var campos map[string]json.RawMessage
+		if err := c.ShouldBindJSON(&campos); err != nil {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		guardar(c, campos)
+	})
+
+	// PUT /estacionamientos/:id — mismo cuerpo que POST /estacionamientos; lo
+	// que no venga queda vacío (salvo cantidad, que si falta no cambia).
+	r.PUT("/estacionamientos/:id", AuthMiddleware(), editar, func(c *gin.Context) {
+		var campos map[string]json.RawMessage
+		if err := c.ShouldBindJSON(&campos); err != nil {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		for _, k := range []string{"nombre", "latitud", "longitud"} {
+			if _, ok := campos[k]; !ok {
+				responderInvalidos(c, []errorValidacion{{Campo: k, Motivo: "obligatorio"}})
+				return
+			}
+		}
+		for _, k := range []string{"precio_por_hora", "techado", "seguridad", "banos", "altura_max_m", "dias"} {
+			if _, ok := campos[k]; !ok {
+				campos[k] = json.RawMessage("null")
+			}
+		}
+		guardar(c, campos)
+	})
+
+	// DELETE /estacionamientos/:id[?cancelar_reservas=true]
+	// Con reservas activas responde 409 salvo que se pida cancelarlas.
+	r.DELETE("/estacionamientos/:id", AuthMiddleware(), RequirePermissionEn(estIDParam("id"), permEstEliminar), func(c *gin.Context) {
+		estID := c.GetInt("estacionamientoID")
+		cancelar := c.Query("cancelar_reservas") == "true"
+
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+
+		var activas int
+		if err := tx.QueryRow(`
+			SELECT COUNT(1) FROM reservas
+			WHERE estacionamiento_id = ? AND status = 1 FOR UPDATE`, estID).Scan(&activas); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if activas > 0 && !cancelar {
+			errores.Responder(c, errores.Nuevo(errores.EstacionamientoConReservas).Con("reservas_activas", activas))
+			return
+		}
+
+		now := time.Now()
+		userID := c.GetInt("userID")
+		motivo := "estacionamiento dado de baja"
+		if _, err := transicionarReservas(tx, `r.estacionamiento_id = ? AND r.status = 1`, []interface{}{estID},
+			reservaCanceladaDuenio, &userID, &motivo, now); err != nil {
+			dbErr(c, err)
+			return
+		}
+		stmts := []struct {
+			q    string
+			args []interface{}
+		}{
+			{`UPDATE api_keys SET revoked_at=? WHERE estacionamiento_id=? AND revoked_at IS NULL`, []interface{}{now, estID}},
+			{`DELETE FROM estacionamiento_staff WHERE estacionamiento_id=?`, []interface{}{estID}},
+			{`DELETE FROM usuario_roles WHERE estacionamiento_id=?`, []interface{}{estID}},
+			{`UPDATE estacionamientos SET eliminado_at=? WHERE id=? AND eliminado_at IS NULL`, []interface{}{now, estID}},
+		}
+		for _, st := range stmts {
+			if _, err := tx.Exec(st.q, st.args...); err != nil {
+				dbErr(c, err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "reservas_canceladas": activas})
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// POST y PATCH /estacionamientos comparten reglas: un nombre que es solo
+// espacios es inválido en los dos.
+func TestNombreEnBlanco(t *testing.T) {
+	motorPrueba()
+	nuevo := EstacionamientoNuevo{Nombre: "   ", Cantidad: 1}
+	if errs := validarStruct(nuevo); len(errs) != 1 || errs[0].Campo != "nombre" {
+		t.Errorf("POST: errores %v, se esperaba nombre", errs)
+	}
+	for _, cuerpo := range []string{`{"nombre": "   "}`, `{"nombre": null}`, `{"nombre": 3}`} {
+		var campos map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(cuerpo), &campos); err != nil {
+			t.Fatal(err)
+		}
+		if _, errs := parsearCambiosEstacionamiento(campos); len(errs) != 1 || errs[0].Campo != "nombre" {
+			t.Errorf("PATCH %s: errores %v, se esperaba nombre", cuerpo, errs)
+		}
+	}
+}
+
+func TestParsearCambiosEstacionamiento(t *testing.T) {
+	motorPrueba()
+	var campos map[string]json.RawMessage
+	cuerpo := `{"nombre": " Centro ", "precio_por_hora": null, "dias": [{"dia": "lunes", "desde": "08:00", "hasta": "20:00"}]}`
+	if err := json.Unmarshal([]byte(cuerpo), &campos); err != nil {
+		t.Fatal(err)
+	}
+	ce, errs := parsearCambiosEstacionamiento(campos)
+	if len(errs) > 0 {
+		t.Fatalf("errores %v", errs)
+	}
+	if len(ce.sets) != 2 || ce.dias == nil || len(*ce.dias) != 1 || ce.cantidad != nil {
+		t.Errorf("cambios %+v", ce)
+	}
+	for i, s := range ce.sets {
+		if s == "nombre = ?" && ce.args[i] != "Centro" {
+			t.Errorf("nombre %q, se esperaba recortado", ce.args[i])
+		}
+	}
+
+	campos = map[string]json.RawMessage{"dias": json.RawMessage(`[{"dia": "feriado", "desde": "08:00", "hasta": "20:00"}]`)}
+	if _, errs := parsearCambiosEstacionamiento(campos); len(errs) != 1 || errs[0].Campo != "dias[0].dia" {
+		t.Errorf("errores %v, se esperaba dias[0].dia", errs)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- ESTADOS DE RESERVA -------------
+// Cada reserva tiene un estado y solo cambia por las transiciones de
+// transicionesReserva; cada cambio guarda su timestamp en la reserva y una
+// fila en reservas_historial. status (1/0) queda como derivado: 1 mientras el
+// estado ocupa cupo, que es lo que miran las consultas de disponibilidad y
+// los índices.
+//
+//	pending ──► confirmed ──► checked_in ──► completed
+//	   │            │              └──────► canceled_by_owner
+//	   │            ├──► no_show / expired
+//	   │            └──► canceled_by_user / canceled_by_owner
+//	   └──► expired / canceled_by_user / canceled_by_owner
+//
+// confirmed pasa a expired (y no a no_show) cuando la llegada no se podía
+// detectar sola (ver vencerNoShows).
+//
+// Las altas por POST /reservas validan el cupo en el momento y nacen
+// confirmed; pending queda para altas que necesiten un paso previo.
+
+type estadoReserva string
+
+const (
+	reservaPendiente        estadoReserva = "pending"
+	reservaConfirmada       estadoReserva = "confirmed"
+	reservaEnCurso          estadoReserva = "checked_in"
+	reservaCompletada       estadoReserva = "completed"
+	reservaCanceladaUsuario estadoReserva = "canceled_by_user"
+	reservaCanceladaDuenio  estadoReserva = "canceled_by_owner"
+	reservaVencida          estadoReserva = "expired"
+	reservaNoShow           estadoReserva = "no_show"
+)
+
+// estadosReserva en el orden del ciclo de vida.
+var estadosReserva = []estadoReserva{
+	reservaPendiente, reservaConfirmada, reservaEnCurso, reservaCompletada,
+	reservaCanceladaUsuario, reservaCanceladaDuenio, reservaVencida, reservaNoShow,
+}
+
+var transicionesReserva = map[estadoReserva][]estadoReserva{
+	reservaPendiente:  {reservaConfirmada, reservaVencida, reservaCanceladaUsuario, reservaCanceladaDuenio},
+	reservaConfirmada: {reservaEnCurso, reservaNoShow, reservaVencida, reservaCanceladaUsuario, reservaCanceladaDuenio},
+	reservaEnCurso:    {reservaCompletada, reservaCanceladaDuenio},
+}
+
+// columnaTransicion es la columna de reservas que guarda cuándo se entró a
+// cada estado.
+var columnaTransicion = map[estadoReserva]string{
+	reservaConfirmada:       "confirmada_at",
+	reservaEnCurso:          "llegada_at",
+	reservaCompletada:       "finalizada_at",
+	reservaVencida:          "finalizada_at",
+	reservaNoShow:           "finalizada_at",
+	reservaCanceladaUsuario: "canceled_at",
+	reservaCanceladaDuenio:  "canceled_at",
+}
+
+var errTransicionInvalida = errors.New("transición de estado de reserva no permitida")
+
+func (e estadoReserva) valido() bool {
+	for _, v := range estadosReserva {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ocupaCupo indica si la reserva en ese estado cuenta contra la capacidad.
+func (e estadoReserva) ocupaCupo() bool {
+	return e == reservaPendiente || e == reservaConfirmada || e == reservaEnCurso
+}
+
+func (e estadoReserva) puedePasarA(hacia estadoReserva) bool {
+	for _, h := range transicionesReserva[e] {
+		if h == hacia {
+			return true
+		}
+	}
+	return false
+}
+
+// registrarHistorial agrega un cambio de estado al historial de la reserva;
+// anterior nil es el alta.
+func registrarHistorial(q consultor, reservaID int64, anterior *estadoReserva, estado estadoReserva, actorID *int, motivo *string, ahora time.Time) error {
+	_, err := q.Exec(`
+		INSERT INTO reservas_historial (reserva_id, estado_anterior, estado, actor_id, motivo, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, reservaID, anterior, estado, actorID, motivo, ahora)
+	return err
+}
+
+type reservaTransicionada struct {
+	ID     int
+	UserID int
+}
+
+// transicionarReservas pasa a hacia las reservas que cumplen filtro (sobre
+// reservas r) y lo permiten; las demás se saltean. El UPDATE es condicional
+// al estado leído, así que si dos procesos compiten solo uno la cambia.
+// q tiene que ser una transacción: el FOR UPDATE las bloquea hasta el
+// commit y el historial se guarda junto con el cambio.
+func transicionarReservas(q consultor, filtro string, args []interface{}, hacia estadoReserva, actorID *int, motivo *string, ahora time.Time) ([]reservaTransicionada, error) {
+	rows, err := q.Query(`SELECT r.id, r.user_id, r.estado FROM reservas r WHERE `+filtro+` FOR UPDATE`, args...)
+	if err != nil {
+		return nil, err
+	}
+	type candidata struct {
+		reservaTransicionada
+		estado estadoReserva
+	}
+	var candidatas []candidata
+	for rows.Next() {
+		var c candidata
+		if err := rows.Scan(&c.ID, &c.UserID, &c.estado); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.estado.puedePasarA(hacia) {
+			candidatas = append(candidatas, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := 0
+	if hacia.ocupaCupo() {
+		status = 1
+	}
+	var out []reservaTransicionada
+	for _, c := range candidatas {
+		res, err := q.Exec(`
+			UPDATE reservas SET estado = ?, status = ?, `+columnaTransicion[hacia]+` = ?, motivo_fin = IFNULL(?, motivo_fin)
+			WHERE id = ? AND estado = ?`, hacia, status, ahora, motivo, c.ID, c.estado)
+		if err != nil {
+			return out, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		anterior := c.estado
+		if err := registrarHistorial(q, int64(c.ID), &anterior, hacia, actorID, motivo, ahora); err != nil {
+			return out, err
+		}
+		out = append(out, c.reservaTransicionada)
+	}
+	return out, nil
+}
+
+// transicionarReserva cambia una reserva puntual; devuelve el estado en que
+// estaba, sql.ErrNoRows si no existe (o no cumple filtro) y
+// errTransicionInvalida si desde ese estado no se puede pasar a hacia.
+func transicionarReserva(id int, filtro string, args []interface{}, hacia estadoReserva, actorID *int, motivo *string, ahora time.Time) (estadoReserva, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var actual estadoReserva
+	err = tx.QueryRow(`SELECT r.estado FROM reservas r WHERE r.id = ? AND `+filtro+` FOR UPDATE`,
+		append([]interface{}{id}, args...)...).Scan(&actual)
+	if err != nil {
+		return "", err
+	}
+	if !actual.puedePasarA(hacia) {
+		return actual, errTransicionInvalida
+	}
+	if _, err := transicionarReservas(tx, `r.id = ?`, []interface{}{id}, hacia, actorID, motivo, ahora); err != nil {
+		return actual, err
+	}
+	return actual, tx.Commit()
+}
+
+// errorTransicionJSON responde los errores de transicionarReserva; devuelve
+// false si err no es uno de ellos.
+func errorTransicionJSON(c *gin.Context, actual estadoReserva, err error) bool {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		fallar(c, errores.ReservaNoEncontrada)
+	case errors.Is(err, errTransicionInvalida):
+		errores.Responder(c, errores.Nuevo(errores.TransicionReservaInvalida).Con("estado", actual))
+	default:
+		return false
+	}
+	return true
+}
+
+type CambioEstadoReserva struct {
+	EstadoAnterior *string   `json:"estado_anterior"`
+	Estado         string    `json:"estado"`
+	ActorID        *int      `json:"actor_id"`
+	Motivo         *string   `json:"motivo"`
+	Fecha          time.Time `json:"fecha"`
+}
+
+func historialReserva(id int) ([]CambioEstadoReserva, error) {
+	rows, err := db.Query(`
+		SELECT estado_anterior, estado, actor_id, motivo, created_at
+		FROM reservas_historial WHERE reserva_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []CambioEstadoReserva{}
+	for rows.Next() {
+		var (
+			h                CambioEstadoReserva
+			anterior, motivo sql.NullString
+			actor            sql.NullInt64
+		)
+		if err := rows.Scan(&anterior, &h.Estado, &actor, &motivo, &h.Fecha); err != nil {
+			return nil, err
+		}
+		h.EstadoAnterior = nullStringPtr(anterior)
+		h.Motivo = nullStringPtr(motivo)
+		if actor.Valid {
+			a := int(actor.Int64)
+			h.ActorID = &a
+		}
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
+
+func registrarRutasEstadosReserva(r *gin.Engine) {
+	// GET /reservas/:id/historial: la reserva y sus cambios de estado, para el
+	// conductor o quien ve las reservas del estacionamiento (dueño, staff,
+	// admin). actor_id null es un cambio automático (vencimientos.go).
+	r.GET("/reservas/:id/historial", AuthMiddleware(), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var userID int
+		reserva, err := scanReserva(db.QueryRow(`
+			SELECT `+columnasReserva+`, r.user_id FROM reservas r
+			LEFT JOIN estacionamientos e ON e.id = r.estacionamiento_id
+			WHERE r.id = ?`, id), &userID)
+		if err == sql.ErrNoRows {
+			fallar(c, errores.ReservaNoEncontrada)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if userID != c.GetInt("userID") {
+			ok, err := tienePermisoEn(c.GetInt("userID"), reserva.EstacionamientoID, permReservasVer)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if !ok {
+				// sin permiso es lo mismo que no existir
+				fallar(c, errores.ReservaNoEncontrada)
+				return
+			}
+		}
+		historial, err := historialReserva(id)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reserva": reserva, "historial": historial})
+	})
+}
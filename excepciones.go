@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- EXCEPCIONES DE HORARIO -------------
+// Feriados y fechas especiales: una fila por estacionamiento y fecha que
+// reemplaza el horario semanal de ese día (ver horarios.go). cerrado=true es
+// cerrado todo el día; si no, desde/hasta como en dias_atencion ("31/12 de
+// 18:00 a 02:00" cruza la medianoche).
+
+//go:embed feriados/ar.json
+var feriadosARJSON []byte
+
+type feriado struct {
+	Fecha  string `json:"fecha"`
+	Nombre string `json:"nombre"`
+}
+
+// feriadosAR son los feriados nacionales por año del archivo embebido.
+var feriadosAR = func() map[string][]feriado {
+	var f struct {
+		Anios map[string][]feriado `json:"anios"`
+	}
+	if err := json.Unmarshal(feriadosARJSON, &f); err != nil {
+		panic("feriados/ar.json inválido: " + err.Error())
+	}
+	return f.Anios
+}()
+
+func aniosFeriados() []string {
+	out := make([]string, 0, len(feriadosAR))
+	for a := range feriadosAR {
+		out = append(out, a)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type ExcepcionHorario struct {
+	Fecha   string  `json:"fecha"`
+	Cerrado bool    `json:"cerrado"`
+	Desde   *string `json:"desde" binding:"omitempty,hora"`
+	Hasta   *string `json:"hasta" binding:"omitempty,hora"`
+	Motivo  *string `json:"motivo" binding:"omitempty,max=100"`
+}
+
+// normalizar exige desde/hasta si no está cerrado y los descarta si lo está.
+func (e *ExcepcionHorario) normalizar() []errorValidacion {
+	if e.Cerrado {
+		e.Desde, e.Hasta = nil, nil
+		return nil
+	}
+	var errs []errorValidacion
+	for _, h := range []struct {
+		campo string
+		valor **string
+	}{{"desde", &e.Desde}, {"hasta", &e.Hasta}} {
+		if *h.valor == nil {
+			errs = append(errs, errorValidacion{Campo: h.campo, Motivo: "obligatorio si no está cerrado"})
+			continue
+		}
+		v := horaHHMM(**h.valor)
+		*h.valor = &v
+	}
+	return errs
+}
+
+// rangosExcepcion pasa una fila de excepciones_horario a rangos del día;
+// cerrado (o un horario que no se entiende) es una lista vacía.
+func rangosExcepcion(cerrado bool, desde, hasta string) []rangoHorario {
+	if cerrado {
+		return nil
+	}
+	d, dur, ok := tramo(desde, hasta)
+	if !ok {
+		return nil
+	}
+	return []rangoHorario{{Desde: d, Duracion: dur}}
+}
+
+// parsearFecha acepta AAAA-MM-DD en la zona horaria del servicio.
+func parsearFecha(s string) (time.Time, bool) {
+	t, err := time.ParseInLocation(formatoFecha, s, zonaHoraria)
+	return t, err == nil
+}
+
+// listarExcepciones devuelve las excepciones de las fechas de [desde, hasta].
+func listarExcepciones(estID int, desde, hasta time.Time) ([]ExcepcionHorario, error) {
+	rows, err := db.Query(`
+		SELECT DATE_FORMAT(fecha, '%Y-%m-%d'), cerrado, desde, hasta, motivo
+		FROM excepciones_horario
+		WHERE estacionamiento_id = ? AND fecha BETWEEN ? AND ?
+		ORDER BY fecha`,
+		estID, desde.Format(formatoFecha), hasta.Format(formatoFecha))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []ExcepcionHorario{}
+	for rows.Next() {
+		var (
+			e                    ExcepcionHorario
+			desdeEx, hastaEx, mo sql.NullString
+		)
+		if err := rows.Scan(&e.Fecha, &e.Cerrado, &desdeEx, &hastaEx, &mo); err != nil {
+			return nil, err
+		}
+		if desdeEx.Valid {
+			e.Desde = &desdeEx.String
+		}
+		if hastaEx.Valid {
+			e.Hasta = &hastaEx.String
+		}
+		if mo.Valid {
+			e.Motivo = &mo.String
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+func registrarRutasExcepciones(r *gin.Engine) {
+	editar := RequirePermissionEn(estIDParam("id"), permEstEditar)
+
+	// GET /estacionamientos/:id/excepciones?desde=2026-12-01&hasta=2026-12-31
+	// Por defecto desde hoy y sin límite.
+	r.GET("/estacionamientos/:id/excepciones", AuthMiddleware(), editar, func(c *gin.Context) {
+		desde := inicioDia(time.Now())
+		hasta := desde.AddDate(100, 0, 0)
+		var errs []errorValidacion
+		for _, q := range []struct {
+			campo string
+			valor *time.Time
+		}{{"desde", &desde}, {"hasta", &hasta}} {
+			if v, ok := c.GetQuery(q.campo); ok {
+				f, ok := parsearFecha(v)
+				if !ok {
+					errs = append(errs, errorValidacion{Campo: q.campo, Motivo: "fecha inválida, formato AAAA-MM-DD"})
+					continue
+				}
+				*q.valor = f
+			}
+		}
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+		list, err := listarExcepciones(c.GetInt("estacionamientoID"), desde, hasta)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"excepciones": list})
+	})
+
+	// PUT /estacionamientos/:id/excepciones/2026-12-25 { "cerrado": true, "motivo": "Navidad" }
+	// PUT /estacionamientos/:id/excepciones/2026-12-31 { "desde": "18:00", "hasta": "02:00" }
+	// Crea o reemplaza la excepción de esa fecha.
+	r.PUT("/estacionamientos/:id/excepciones/:fecha", AuthMiddleware(), editar, func(c *gin.Context) {
+		var in ExcepcionHorario
+		if !bindJSON(c, &in) {
+			return
+		}
+		errs := in.normalizar()
+		if _, ok := parsearFecha(c.Param("fecha")); !ok {
+			errs = append([]errorValidacion{{Campo: "fecha", Motivo: "fecha inválida, formato AAAA-MM-DD"}}, errs...)
+		}
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+		in.Fecha = c.Param("fecha")
+		if in.Motivo != nil {
+			m := strings.TrimSpace(*in.Motivo)
+			in.Motivo = &m
+		}
+		if _, err := db.Exec(`
+			INSERT INTO excepciones_horario (estacionamiento_id, fecha, cerrado, desde, hasta, motivo)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE cerrado = VALUES(cerrado), desde = VALUES(desde),
+				hasta = VALUES(hasta), motivo = VALUES(motivo)`,
+			c.GetInt("estacionamientoID"), in.Fecha, in.Cerrado, in.Desde, in.Hasta, in.Motivo); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, in)
+	})
+
+	// DELETE /estacionamientos/:id/excepciones/2026-12-25
+	r.DELETE("/estacionamientos/:id/excepciones/:fecha", AuthMiddleware(), editar, func(c *gin.Context) {
+		if _, ok := parsearFecha(c.Param("fecha")); !ok {
+			responderInvalidos(c, []errorValidacion{{Campo: "fecha", Motivo: "fecha inválida, formato AAAA-MM-DD"}})
+			return
+		}
+		res, err := db.Exec(`DELETE FROM excepciones_horario WHERE estacionamiento_id = ? AND fecha = ?`,
+			c.GetInt("estacionamientoID"), c.Param("fecha"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			fallar(c, errores.ExcepcionNoEncontrada)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /estacionamientos/:id/excepciones/feriados { "anio": 2026 }
+	// Carga los feriados nacionales del año como cerrado (o con desde/hasta
+	// si se mandan). Las fechas que ya tienen excepción no se tocan.
+	r.POST("/estacionamientos/:id/excepciones/feriados", AuthMiddleware(), editar, func(c *gin.Context) {
+		var in struct {
+			Anio  int     `json:"anio" binding:"required"`
+			Desde *string `json:"desde" binding:"omitempty,hora"`
+			Hasta *string `json:"hasta" binding:"omitempty,hora"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		plantilla := ExcepcionHorario{Cerrado: in.Desde == nil && in.Hasta == nil, Desde: in.Desde, Hasta: in.Hasta}
+		errs := plantilla.normalizar()
+		feriados, ok := feriadosAR[strconv.Itoa(in.Anio)]
+		if !ok {
+			errs = append([]errorValidacion{{Campo: "anio", Motivo: "años disponibles: " + strings.Join(aniosFeriados(), ", ")}}, errs...)
+		}
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+		importados := 0
+		for _, f := range feriados {
+			res, err := tx.Exec(`
+				INSERT IGNORE INTO excepciones_horario (estacionamiento_id, fecha, cerrado, desde, hasta, motivo)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				c.GetInt("estacionamientoID"), f.Fecha, plantilla.Cerrado, plantilla.Desde, plantilla.Hasta, f.Nombre)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			n, _ := res.RowsAffected()
+			importados += int(n)
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		fmt.Printf("📅 Feriados %d importados en estacionamiento %d: %d\n", in.Anio, c.GetInt("estacionamientoID"), importados)
+		c.JSON(http.StatusOK, gin.H{"importados": importados, "omitidos": len(feriados) - importados})
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ----------- BÚSQUEDA GEOGRÁFICA -------------
+// GET /estacionamientos acepta ?lat=&lng=&radio_m= o ?bbox=minLng,minLat,maxLng,maxLat.
+// La preselección usa el índice espacial sobre estacionamientos.ubicacion
+// (POINT(longitud, latitud) generado); la distancia exacta (ST_Distance_Sphere)
+// se calcula en SQL para poder ordenar, cortar por cursor y limitar ahí.
+// GEO_BUSQUEDA=haversine evita las funciones espaciales: preselecciona con
+// latitud/longitud y calcula haversine en SQL (para bases sin soporte
+// espacial). GEO_BUSQUEDA=memoria tampoco usa trigonometría en SQL: trae lo
+// que cae en la caja y calcula la distancia, el orden y el cursor en Go con
+// haversineM (para bases de prueba mínimas; la caja acota lo que se trae).
+// Los tests comparan los tres con haversineM (geo_test.go).
+
+const radioTierraM = 6371008.8
+
+const (
+	radioDefaultM = 5000
+	radioMaximoM  = 50000
+)
+
+func busquedaEspacial() bool {
+	m := os.Getenv("GEO_BUSQUEDA")
+	return m != "haversine" && m != "memoria"
+}
+
+// distanciaEnGo indica si la distancia se calcula fuera de la base.
+func distanciaEnGo() bool {
+	return os.Getenv("GEO_BUSQUEDA") == "memoria"
+}
+
+// haversineM es la distancia en metros sobre la esfera de radioTierraM, la
+// misma que calcula ST_Distance_Sphere.
+func haversineM(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * radioTierraM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type cajaGeo struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+// cajaAlrededor devuelve una caja que contiene el círculo de radioM.
+func cajaAlrededor(lat, lng, radioM float64) cajaGeo {
+	ang := radioM / radioTierraM
+	dLat := ang * 180 / math.Pi
+	dLng := 180.0
+	// el ancho máximo del círculo no es dLat/cos(lat) sino asin(sen/cos);
+	// si el círculo toca el polo abarca todas las longitudes
+	if cos := math.Cos(lat * math.Pi / 180); cos > math.Sin(ang) {
+		dLng = math.Asin(math.Sin(ang)/cos) * 180 / math.Pi
+	}
+	return cajaGeo{
+		MinLat: math.Max(-90, lat-dLat), MaxLat: math.Min(90, lat+dLat),
+		MinLng: math.Max(-180, lng-dLng), MaxLng: math.Min(180, lng+dLng),
+	}
+}
+
+// filtroSQL devuelve la condición sobre el alias e que preselecciona la caja.
+func (z cajaGeo) filtroSQL() (string, []interface{}) {
+	if busquedaEspacial() {
+		poly := fmt.Sprintf("POLYGON((%[1]f %[2]f, %[3]f %[2]f, %[3]f %[4]f, %[1]f %[4]f, %[1]f %[2]f))",
+			z.MinLng, z.MinLat, z.MaxLng, z.MaxLat)
+		return `MBRContains(ST_GeomFromText(?), e.ubicacion)`, []interface{}{poly}
+	}
+	return `e.latitud BETWEEN ? AND ? AND e.longitud BETWEEN ? AND ?`,
+		[]interface{}{z.MinLat, z.MaxLat, z.MinLng, z.MaxLng}
+}
+
+// zonaGeo es lo que pidió el cliente: un círculo, una caja o nada.
+type zonaGeo struct {
+	Caja     *cajaGeo
+	Lat, Lng float64 // punto desde el que se mide distancia_m
+	RadioM   float64 // 0 si es solo caja
+	ConPunto bool
+}
+
+// parsearZonaGeo lee lat/lng/radio_m y bbox de la query. Sin ninguno
+// devuelve una zona vacía (Caja nil).
+func parsearZonaGeo(c *gin.Context) (zonaGeo, []errorValidacion) {
+	var (
+		z    zonaGeo
+		errs []errorValidacion
+	)
+	num := func(campo string, min, max float64) (float64, bool) {
+		v, err := strconv.ParseFloat(c.Query(campo), 64)
+		if err != nil || math.IsNaN(v) || v < min || v > max {
+			errs = append(errs, errorValidacion{Campo: campo, Motivo: fmt.Sprintf("debe ser un número entre %g y %g", min, max)})
+			return 0, false
+		}
+		return v, true
+	}
+
+	_, hayLat := c.GetQuery("lat")
+	_, hayLng := c.GetQuery("lng")
+	if hayLat != hayLng {
+		errs = append(errs, errorValidacion{Campo: "lat,lng", Motivo: "van juntos"})
+	}
+	if hayLat && hayLng {
+		lat, ok1 := num("lat", -90, 90)
+		lng, ok2 := num("lng", -180, 180)
+		if ok1 && ok2 {
+			z.Lat, z.Lng, z.ConPunto = lat, lng, true
+		}
+	}
+
+	if bbox, ok := c.GetQuery("bbox"); ok {
+		partes := strings.Split(bbox, ",")
+		var v [4]float64
+		valido := len(partes) == 4
+		for i := 0; valido && i < 4; i++ {
+			f, err := strconv.ParseFloat(strings.TrimSpace(partes[i]), 64)
+			valido = err == nil
+			v[i] = f
+		}
+		caja := cajaGeo{MinLng: v[0], MinLat: v[1], MaxLng: v[2], MaxLat: v[3]}
+		if !valido || caja.MinLat > caja.MaxLat || caja.MinLng > caja.MaxLng ||
+			caja.MinLat < -90 || caja.MaxLat > 90 || caja.MinLng < -180 || caja.MaxLng > 180 {
+			errs = append(errs, errorValidacion{Campo: "bbox", Motivo: "formato minLng,minLat,maxLng,maxLat"})
+		} else {
+			z.Caja = &caja
+			if !z.ConPunto && !hayLat {
+				// sin punto explícito se ordena desde el centro de la caja
+				z.Lat, z.Lng = (caja.MinLat+caja.MaxLat)/2, (caja.MinLng+caja.MaxLng)/2
+				z.ConPunto = true
+			}
+		}
+	}
+
+	if _, ok := c.GetQuery("radio_m"); ok || (z.ConPunto && z.Caja == nil) {
+		z.RadioM = radioDefaultM
+		if ok {
+			z.RadioM, _ = num("radio_m", 1, radioMaximoM)
+		}
+		if !hayLat {
+			errs = append(errs, errorValidacion{Campo: "radio_m", Motivo: "requiere lat y lng"})
+		}
+	}
+	if len(errs) > 0 {
+		return z, errs
+	}
+	if z.RadioM > 0 {
+		caja := cajaAlrededor(z.Lat, z.Lng, z.RadioM)
+		if z.Caja == nil {
+			z.Caja = &caja
+		}
+	}
+	return z, nil
+}
+
+// numSQL escribe un float64 validado como literal SQL.
+func numSQL(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// distanciaSQL devuelve la expresión (sobre el alias e) con la distancia en
+// metros al punto de la zona, o "" si no hay punto o se calcula en Go. Los
+// números van como literales porque la expresión se repite en SELECT, WHERE
+// y ORDER BY.
+func (z zonaGeo) distanciaSQL() string {
+	if !z.ConPunto || distanciaEnGo() {
+		return ""
+	}
+	lat, lng, r := numSQL(z.Lat), numSQL(z.Lng), numSQL(radioTierraM)
+	if busquedaEspacial() {
+		return fmt.Sprintf("ST_Distance_Sphere(e.ubicacion, POINT(%s, %s), %s)", lng, lat, r)
+	}
+	return fmt.Sprintf("(2 * %[3]s * ASIN(LEAST(1, SQRT("+
+		"POW(SIN(RADIANS(e.latitud - %[1]s) / 2), 2) + "+
+		"COS(RADIANS(%[1]s)) * COS(RADIANS(e.latitud)) * POW(SIN(RADIANS(e.longitud - %[2]s) / 2), 2)))))",
+		lat, lng, r)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// destino es el punto a distM de (lat, lng) con rumbo grados.
+func destino(lat, lng, rumbo, distM float64) (float64, float64) {
+	rad := math.Pi / 180
+	d := distM / radioTierraM
+	la1, lo1, th := lat*rad, lng*rad, rumbo*rad
+	la2 := math.Asin(math.Sin(la1)*math.Cos(d) + math.Cos(la1)*math.Sin(d)*math.Cos(th))
+	lo2 := lo1 + math.Atan2(math.Sin(th)*math.Sin(d)*math.Cos(la1), math.Cos(d)-math.Sin(la1)*math.Sin(la2))
+	return la2 / rad, lo2 / rad
+}
+
+func TestHaversineM(t *testing.T) {
+	if d := haversineM(0, 0, 0, 1); math.Abs(d-111195) > 1 {
+		t.Errorf("1° de longitud en el ecuador = %.1f m, se esperaba ~111195", d)
+	}
+	if d := haversineM(-34.6, -58.4, -34.6, -58.4); d != 0 {
+		t.Errorf("mismo punto = %v m", d)
+	}
+	lat, lng := destino(-34.6, -58.4, 37, 2500)
+	if d := haversineM(-34.6, -58.4, lat, lng); math.Abs(d-2500) > 0.01 {
+		t.Errorf("destino a 2500 m quedó a %.3f m", d)
+	}
+}
+
+func TestCajaAlrededorContieneCirculo(t *testing.T) {
+	for _, c := range []struct{ lat, lng, radio float64 }{
+		{-34.6037, -58.3816, 5000},
+		{0, 0, 50000},
+		{-54.8, -68.3, 50000},
+		{70, 179.9, 20000},
+	} {
+		caja := cajaAlrededor(c.lat, c.lng, c.radio)
+		for rumbo := 0.0; rumbo < 360; rumbo += 5 {
+			lat, lng := destino(c.lat, c.lng, rumbo, c.radio)
+			if lng > 180 {
+				continue // la caja no cruza el antimeridiano: se recorta en 180
+			}
+			if lat < caja.MinLat || lat > caja.MaxLat || lng < caja.MinLng || lng > caja.MaxLng {
+				t.Errorf("%+v: el punto (%f, %f) a rumbo %v queda fuera de %+v", c, lat, lng, rumbo, caja)
+			}
+		}
+	}
+}
+
+func TestParsearZonaGeo(t *testing.T) {
+	for _, c := range []struct {
+		query   string
+		errores []string
+		radio   float64
+		punto   bool
+	}{
+		{query: ""},
+		{query: "lat=-34.6&lng=-58.4", radio: radioDefaultM, punto: true},
+		{query: "lat=-34.6&lng=-58.4&radio_m=800", radio: 800, punto: true},
+		{query: "bbox=-58.5,-34.7,-58.3,-34.5", punto: true},
+		{query: "lat=-34.6", errores: []string{"lat,lng"}},
+		{query: "lat=91&lng=0", errores: []string{"lat"}},
+		{query: "lat=0&lng=0&radio_m=60000", errores: []string{"radio_m"}},
+		{query: "radio_m=100", errores: []string{"radio_m"}},
+		{query: "bbox=-58.3,-34.7,-58.5,-34.5", errores: []string{"bbox"}},
+		{query: "bbox=1,2,3", errores: []string{"bbox"}},
+	} {
+		c2, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c2.Request = httptest.NewRequest(http.MethodGet, "/?"+c.query, nil)
+		z, errs := parsearZonaGeo(c2)
+		var campos []string
+		for _, e := range errs {
+			campos = append(campos, e.Campo)
+		}
+		if len(campos) != len(c.errores) {
+			t.Errorf("%q: errores %v, se esperaba %v", c.query, campos, c.errores)
+			continue
+		}
+		for i := range campos {
+			if campos[i] != c.errores[i] {
+				t.Errorf("%q: errores %v, se esperaba %v", c.query, campos, c.errores)
+			}
+		}
+		if len(errs) > 0 {
+			continue
+		}
+		if z.RadioM != c.radio || z.ConPunto != c.punto {
+			t.Errorf("%q: radio %v punto %v, se esperaba %v %v", c.query, z.RadioM, z.ConPunto, c.radio, c.punto)
+		}
+		if (z.RadioM > 0 || c.punto) && z.Caja == nil {
+			t.Errorf("%q: sin caja de preselección", c.query)
+		}
+	}
+}
+
+// Con GEO_BUSQUEDA=memoria el recorte por radio, el orden y el cursor van en
+// Go: paginando de a lote tiene que salir lo mismo que ordenando todo junto.
+func TestDistanciasEnGo(t *testing.T) {
+	const lat, lng, radio = -34.6037, -58.3816, 3000.0
+	zona := zonaGeo{Lat: lat, Lng: lng, RadioM: radio, ConPunto: true}
+	rnd := rand.New(rand.NewSource(2))
+	var (
+		todos  []itemLista
+		dentro []int64
+	)
+	for i := 1; i <= 40; i++ {
+		la, lo := destino(lat, lng, rnd.Float64()*360, rnd.Float64()*2*radio)
+		todos = append(todos, itemLista{ID: int64(i), Latitud: la, Longitud: lo})
+		if haversineM(lat, lng, la, lo) <= radio {
+			dentro = append(dentro, int64(i))
+		}
+	}
+	sort.Slice(dentro, func(i, j int) bool {
+		a, b := todos[dentro[i]-1], todos[dentro[j]-1]
+		return haversineM(lat, lng, a.Latitud, a.Longitud) < haversineM(lat, lng, b.Latitud, b.Longitud)
+	})
+
+	var (
+		got    []int64
+		cursor *cursorLista
+	)
+	for pagina := 0; pagina < 100; pagina++ {
+		lote := distanciasEnGo(append([]itemLista{}, todos...), zona, "distancia", cursor, 6)
+		for _, it := range lote {
+			got = append(got, it.ID)
+		}
+		if len(lote) < 6 {
+			break
+		}
+		ult := lote[len(lote)-1]
+		cursor = &cursorLista{Valor: valorOrden("distancia", ult), ID: ult.ID}
+	}
+	if len(got) != len(dentro) {
+		t.Fatalf("%d resultados, se esperaban %d", len(got), len(dentro))
+	}
+	for i := range got {
+		if got[i] != dentro[i] {
+			t.Errorf("posición %d: id %d, se esperaba %d", i, got[i], dentro[i])
+		}
+	}
+}
+
+// paginarLista recorre GET /estacionamientos siguiendo el cursor.
+func paginarLista(t *testing.T, r *gin.Engine, query url.Values) []itemLista {
+	t.Helper()
+	var todos []itemLista
+	for pagina := 0; pagina < 100; pagina++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/estacionamientos?"+query.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /estacionamientos?%s: %d %s", query.Encode(), w.Code, w.Body.String())
+		}
+		var resp struct {
+			Estacionamientos []itemLista `json:"estacionamientos"`
+			Siguiente        *string     `json:"siguiente"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		todos = append(todos, resp.Estacionamientos...)
+		if resp.Siguiente == nil {
+			return todos
+		}
+		query.Set("cursor", *resp.Siguiente)
+	}
+	t.Fatal("la paginación no termina")
+	return nil
+}
+
+func TestBusquedaPorDistancia(t *testing.T) {
+	dbPrueba(t)
+	r := motorPrueba()
+	registrarRutasBusqueda(r)
+
+	const lat, lng, radio = -34.6037, -58.3816, 3000.0
+	type lote struct {
+		id   int64
+		dist float64
+	}
+	var dentro []lote
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 60; i++ {
+		la, lo := destino(lat, lng, rnd.Float64()*360, rnd.Float64()*2*radio)
+		d := haversineM(lat, lng, la, lo)
+		if math.Abs(d-radio) < 1 {
+			continue // en el borde el redondeo de SQL puede dejarlo de cualquier lado
+		}
+		res, err := db.Exec(`INSERT INTO estacionamientos (duenio_id, nombre, latitud, longitud) VALUES (1, ?, ?, ?)`,
+			"e", la, lo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		if d <= radio {
+			dentro = append(dentro, lote{id, d})
+		}
+	}
+	sort.Slice(dentro, func(i, j int) bool { return dentro[i].dist < dentro[j].dist })
+
+	for _, modo := range []string{"", "haversine", "memoria"} {
+		t.Run("GEO_BUSQUEDA="+modo, func(t *testing.T) {
+			t.Setenv("GEO_BUSQUEDA", modo)
+			q := url.Values{"lat": {numSQL(lat)}, "lng": {numSQL(lng)}, "radio_m": {numSQL(radio)}, "limite": {"7"}}
+			got := paginarLista(t, r, q)
+			if len(got) != len(dentro) {
+				t.Fatalf("%d resultados, se esperaban %d", len(got), len(dentro))
+			}
+			for i, it := range got {
+				if it.ID != dentro[i].id {
+					t.Errorf("posición %d: id %d, se esperaba %d", i, it.ID, dentro[i].id)
+				}
+				if it.DistanciaM == nil || math.Abs(*it.DistanciaM-dentro[i].dist) > 1 {
+					t.Errorf("id %d: distancia_m %v, haversine %.1f", it.ID, it.DistanciaM, dentro[i].dist)
+				}
+			}
+		})
+	}
+}
+
+func TestBusquedaPorPrecioPagina(t *testing.T) {
+	dbPrueba(t)
+	r := motorPrueba()
+	registrarRutasBusqueda(r)
+
+	// precios repetidos y sin precio para probar el desempate por id
+	precios := []interface{}{300, nil, 150, 300, 150, nil, 500, 300, 100, nil, 150}
+	for _, p := range precios {
+		if _, err := db.Exec(`INSERT INTO estacionamientos (duenio_id, nombre, latitud, longitud, precio_por_hora) VALUES (1, 'e', 0, 0, ?)`, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := paginarLista(t, r, url.Values{"orden": {"precio"}, "limite": {"3"}})
+	if len(got) != len(precios) {
+		t.Fatalf("%d resultados, se esperaban %d", len(got), len(precios))
+	}
+	for i := 1; i < len(got); i++ {
+		a, b := valorOrden("precio", got[i-1]), valorOrden("precio", got[i])
+		if a > b || (a == b && got[i-1].ID >= got[i].ID) {
+			t.Errorf("posiciones %d y %d fuera de orden: (%v, %d) (%v, %d)", i-1, i, a, got[i-1].ID, b, got[i].ID)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------- HORARIOS DE ATENCIÓN -------------
+// dias_atencion guarda texto libre (dia, desde, hasta). Acá se pasa a rangos
+// tipados por día de la semana en la zona horaria del servicio (ZONA_HORARIA,
+// por defecto America/Argentina/Buenos_Aires). Un rango con hasta <= desde
+// cruza la medianoche ("22:00"-"06:00"); desde == hasta o "00:00"-"24:00" es
+// el día completo. Las excepciones por fecha (feriados, ver excepciones.go)
+// reemplazan el horario semanal de ese día.
+
+var zonaHoraria = cargarZonaHoraria()
+
+func cargarZonaHoraria() *time.Location {
+	nombre := os.Getenv("ZONA_HORARIA")
+	if nombre == "" {
+		nombre = "America/Argentina/Buenos_Aires"
+	}
+	loc, err := time.LoadLocation(nombre)
+	if err != nil {
+		// sin tzdata en la imagen: Argentina no tiene horario de verano
+		return time.FixedZone("ART", -3*60*60)
+	}
+	return loc
+}
+
+const minutosDia = 24 * 60
+
+// rangoHorario es un tramo de atención que empieza el día Dia a los Desde
+// minutos y dura Duracion minutos (puede pasar al día siguiente).
+type rangoHorario struct {
+	Dia      time.Weekday
+	Desde    int
+	Duracion int
+}
+
+// horario de un estacionamiento. excepciones va por fecha (AAAA-MM-DD); una
+// lista vacía es cerrado todo el día.
+type horario struct {
+	rangos      []rangoHorario
+	excepciones map[string][]rangoHorario
+}
+
+const formatoFecha = "2006-01-02"
+
+// conocido indica si hay horario semanal cargado; sin él no se sabe si está
+// abierto aunque haya excepciones.
+func (h horario) conocido() bool {
+	return len(h.rangos) > 0
+}
+
+func (h *horario) agregarExcepcion(fecha string, rs []rangoHorario) {
+	if h.excepciones == nil {
+		h.excepciones = map[string][]rangoHorario{}
+	}
+	h.excepciones[fecha] = append(h.excepciones[fecha], rs...)
+	if h.excepciones[fecha] == nil {
+		h.excepciones[fecha] = []rangoHorario{}
+	}
+}
+
+// intervalo concreto [Desde, Hasta) en el tiempo.
+type intervalo struct {
+	Desde, Hasta time.Time
+}
+
+// diaSemana acepta "lunes", "Lunes", "miércoles", "lun", "mie"...
+func diaSemana(s string) (time.Weekday, bool) {
+	s = normalizarDia(s)
+	for i, d := range diasSemana {
+		if s == d || (len(s) >= 2 && strings.HasPrefix(d, s)) {
+			return time.Weekday((i + 1) % 7), true
+		}
+	}
+	return 0, false
+}
+
+// diasDeTexto resuelve "lunes", "todos", "lunes a viernes" o "lun-vie".
+func diasDeTexto(s string) []time.Weekday {
+	s = normalizarDia(s)
+	if s == "todos" || s == "todos los dias" {
+		return []time.Weekday{0, 1, 2, 3, 4, 5, 6}
+	}
+	for _, sep := range []string{" a ", "-"} {
+		if partes := strings.SplitN(s, sep, 2); len(partes) == 2 {
+			ini, ok1 := diaSemana(partes[0])
+			fin, ok2 := diaSemana(partes[1])
+			if !ok1 || !ok2 {
+				return nil
+			}
+			var out []time.Weekday
+			for d := ini; ; d = (d + 1) % 7 {
+				out = append(out, d)
+				if d == fin {
+					break
+				}
+			}
+			return out
+		}
+	}
+	if d, ok := diaSemana(s); ok {
+		return []time.Weekday{d}
+	}
+	return nil
+}
+
+// minutosDeHora convierte "9:00", "09:00", "09:00:00" o "24:00".
+func minutosDeHora(s string) (int, bool) {
+	partes := strings.Split(strings.TrimSpace(s), ":")
+	if len(partes) < 2 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(partes[0])
+	m, err2 := strconv.Atoi(partes[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// tramo pasa desde/hasta a minuto de inicio y duración.
+func tramo(desde, hasta string) (int, int, bool) {
+	d, ok1 := minutosDeHora(desde)
+	h, ok2 := minutosDeHora(hasta)
+	if !ok1 || !ok2 || d == minutosDia {
+		return 0, 0, false
+	}
+	dur := h - d
+	if dur <= 0 {
+		dur += minutosDia
+	}
+	return d, dur, true
+}
+
+// parsearRango devuelve los rangos de una fila de dias_atencion; las filas
+// que no se entienden se ignoran.
+func parsearRango(dia, desde, hasta string) []rangoHorario {
+	d, dur, ok := tramo(desde, hasta)
+	if !ok {
+		return nil
+	}
+	var out []rangoHorario
+	for _, wd := range diasDeTexto(dia) {
+		out = append(out, rangoHorario{Dia: wd, Desde: d, Duracion: dur})
+	}
+	return out
+}
+
+func inicioDia(t time.Time) time.Time {
+	t = t.In(zonaHoraria)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, zonaHoraria)
+}
+
+// ventanaEstado es el rango de fechas que mira estado(t): desde el día
+// anterior (tramos que cruzan la medianoche) hasta 8 días después.
+func ventanaEstado(t time.Time) (time.Time, time.Time) {
+	base := inicioDia(t)
+	return base.AddDate(0, 0, -1), base.AddDate(0, 0, 9)
+}
+
+// recortar quita de un tramo semanal los días cerrados por excepción: "25/12
+// cerrado" también corta lo que venía del 24 pasada la medianoche. Una
+// excepción con horario solo reemplaza los tramos que empiezan ese día.
+func (h horario) recortar(iv intervalo) []intervalo {
+	if len(h.excepciones) == 0 {
+		return []intervalo{iv}
+	}
+	var out []intervalo
+	for ini := iv.Desde; ini.Before(iv.Hasta); {
+		dia := inicioDia(ini)
+		fin := dia.AddDate(0, 0, 1)
+		if fin.After(iv.Hasta) {
+			fin = iv.Hasta
+		}
+		if rs, ok := h.excepciones[dia.Format(formatoFecha)]; !ok || len(rs) > 0 {
+			out = append(out, intervalo{ini, fin})
+		}
+		ini = fin
+	}
+	return out
+}
+
+// intervalos devuelve los tramos concretos que tocan [t-1 día, t+8 días),
+// ordenados y con los contiguos unidos.
+func (h horario) intervalos(t time.Time) []intervalo {
+	return h.intervalosEntre(ventanaEstado(t))
+}
+
+// intervalosEntre arma los tramos que empiezan los días de [desde, hasta).
+// Un día con excepción usa solo los rangos de la excepción.
+func (h horario) intervalosEntre(desde, hasta time.Time) []intervalo {
+	var ivs []intervalo
+	for dia := inicioDia(desde); dia.Before(hasta); dia = dia.AddDate(0, 0, 1) {
+		rangos, especial := h.excepciones[dia.Format(formatoFecha)]
+		if !especial {
+			rangos = h.rangos
+		}
+		for _, r := range rangos {
+			if !especial && r.Dia != dia.Weekday() {
+				continue
+			}
+			ini := dia.Add(time.Duration(r.Desde) * time.Minute)
+			iv := intervalo{ini, ini.Add(time.Duration(r.Duracion) * time.Minute)}
+			if especial {
+				ivs = append(ivs, iv)
+			} else {
+				ivs = append(ivs, h.recortar(iv)...)
+			}
+		}
+	}
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i].Desde.Before(ivs[j].Desde) })
+	var out []intervalo
+	for _, iv := range ivs {
+		if n := len(out); n > 0 && !iv.Desde.After(out[n-1].Hasta) {
+			if iv.Hasta.After(out[n-1].Hasta) {
+				out[n-1].Hasta = iv.Hasta
+			}
+			continue
+		}
+		out = append(out, iv)
+	}
+	return out
+}
+
+// estadoHorario es lo que se expone en lista y detalle. Sin horario cargado
+// AbiertoAhora queda nil (no se sabe).
+type estadoHorario struct {
+	AbiertoAhora *bool      `json:"abierto_ahora"`
+	AbreA        *time.Time `json:"abre_a"`
+	CierraA      *time.Time `json:"cierra_a"`
+}
+
+// estado calcula si está abierto en t y el próximo cambio. Si está abierto
+// toda la ventana calculada (24 h todos los días) cierra_a queda nil.
+func (h horario) estado(t time.Time) estadoHorario {
+	var e estadoHorario
+	if !h.conocido() {
+		return e
+	}
+	t = t.In(zonaHoraria)
+	abierto := false
+	e.AbiertoAhora = &abierto
+	ivs := h.intervalos(t)
+	fin := inicioDia(t).AddDate(0, 0, 8)
+	for _, iv := range ivs {
+		if !iv.Desde.After(t) && t.Before(iv.Hasta) {
+			abierto = true
+			if iv.Hasta.Before(fin) {
+				cierra := iv.Hasta
+				e.CierraA = &cierra
+			}
+			return e
+		}
+		if iv.Desde.After(t) {
+			abre := iv.Desde
+			e.AbreA = &abre
+			return e
+		}
+	}
+	return e
+}
+
+// abiertoEntre indica si [desde, hasta) cae entero dentro de un tramo de
+// atención. Sin horario conocido no se restringe.
+func (h horario) abiertoEntre(desde, hasta time.Time) bool {
+	if !h.conocido() {
+		return true
+	}
+	for _, iv := range h.intervalosEntre(desde.AddDate(0, 0, -1), hasta.AddDate(0, 0, 1)) {
+		if !iv.Desde.After(desde) && !hasta.After(iv.Hasta) {
+			return true
+		}
+	}
+	return false
+}
+
+// ordenDia da la posición de la semana (lunes primero) para ordenar filas
+// de dias_atencion; las que no se entienden van al final.
+func ordenDia(dia string) int {
+	dias := diasDeTexto(dia)
+	if len(dias) == 0 {
+		return 7
+	}
+	return (int(dias[0]) + 6) % 7
+}
+
+// cargarHorarios lee dias_atencion de los estacionamientos pedidos y las
+// excepciones de las fechas de [desde, hasta].
+func cargarHorarios(ids []int64, desde, hasta time.Time) (map[int64]horario, error) {
+	out := map[int64]horario{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	marcas := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(`
+		SELECT estacionamiento_id, dia, desde, hasta
+		FROM dias_atencion WHERE estacionamiento_id IN (`+marcas+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id                int64
+			dia, desde, hasta string
+		)
+		if err := rows.Scan(&id, &dia, &desde, &hasta); err != nil {
+			return nil, err
+		}
+		h := out[id]
+		h.rangos = append(h.rangos, parsearRango(dia, desde, hasta)...)
+		out[id] = h
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	excs, err := db.Query(`
+		SELECT estacionamiento_id, DATE_FORMAT(fecha, '%Y-%m-%d'), cerrado, IFNULL(desde, ''), IFNULL(hasta, '')
+		FROM excepciones_horario
+		WHERE estacionamiento_id IN (`+marcas+`) AND fecha BETWEEN ? AND ?`,
+		append(args, inicioDia(desde).Format(formatoFecha), inicioDia(hasta).Format(formatoFecha))...)
+	if err != nil {
+		return nil, err
+	}
+	defer excs.Close()
+	for excs.Next() {
+		var (
+			id                      int64
+			fecha, desdeEx, hastaEx string
+			cerrado                 bool
+		)
+		if err := excs.Scan(&id, &fecha, &cerrado, &desdeEx, &hastaEx); err != nil {
+			return nil, err
+		}
+		h := out[id]
+		h.agregarExcepcion(fecha, rangosExcepcion(cerrado, desdeEx, hastaEx))
+		out[id] = h
+	}
+	return out, excs.Err()
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ----------- LLAVES JWT (RS256 / EdDSA) -------------
+// Los access tokens se firman con una llave privada identificada por `kid`;
+// cualquier servicio los puede verificar con GET /.well-known/jwks.json.
+//
+// JWT_KEYS_SOURCE=db (default): las llaves viven en `jwt_llaves` cifradas
+// con JWT_KEYS_SECRET (AES-256-GCM) y se rotan solas cada
+// JWT_ROTATION_INTERVAL (JWT_ALG=EdDSA|RS256 para las nuevas). La llave nueva
+// se publica en el JWKS anticipoLlaveNueva antes de empezar a firmar, así
+// quien tiene el JWKS cacheado ya la conoce cuando llegan tokens con su kid.
+// JWT_KEYS_SOURCE=file: se leen los PEM de JWT_KEYS_DIR (kid = nombre del
+// archivo); firma JWT_ACTIVE_KID o la privada más nueva, y los PEM con solo
+// llave pública quedan para verificar. La rotación la hace quien deja archivos.
+
+type llaveJWT struct {
+	Kid     string
+	Metodo  jwt.SigningMethod
+	Privada crypto.Signer // nil si solo sirve para verificar
+	Publica crypto.PublicKey
+	Creada  time.Time
+}
+
+type almacenLlaves struct {
+	mu           sync.RWMutex
+	firmante     *llaveJWT
+	llaves       map[string]*llaveJWT
+	ultimaCarga  time.Time
+	recargarFunc func() ([]*llaveJWT, string, error)
+}
+
+var llavesJWT = &almacenLlaves{llaves: map[string]*llaveJWT{}}
+
+// intervalo mínimo entre recargas disparadas por un kid desconocido
+const recargaMinimaLlaves = 10 * time.Second
+
+const (
+	// max-age de GET /.well-known/jwks.json
+	jwksMaxAge = 5 * time.Minute
+	// cuánto antes de firmar se publica una llave nueva: más que el cache
+	// del JWKS y que el intervalo de recarga de las réplicas
+	anticipoLlaveNueva = 2 * jwksMaxAge
+)
+
+func (a *almacenLlaves) reemplazar(llaves []*llaveJWT, kidActivo string) error {
+	m := make(map[string]*llaveJWT, len(llaves))
+	var firmante *llaveJWT
+	for _, l := range llaves {
+		m[l.Kid] = l
+		if l.Kid == kidActivo && l.Privada != nil {
+			firmante = l
+		}
+	}
+	if firmante == nil {
+		return fmt.Errorf("no hay llave privada para el kid activo %q", kidActivo)
+	}
+	a.mu.Lock()
+	a.llaves, a.firmante, a.ultimaCarga = m, firmante, time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *almacenLlaves) recargar() error {
+	llaves, kid, err := a.recargarFunc()
+	if err != nil {
+		return err
+	}
+	return a.reemplazar(llaves, kid)
+}
+
+func (a *almacenLlaves) firmar(claims jwt.Claims) (string, error) {
+	a.mu.RLock()
+	l := a.firmante
+	a.mu.RUnlock()
+	if l == nil {
+		return "", errors.New("llaves JWT no cargadas")
+	}
+	t := jwt.NewWithClaims(l.Metodo, claims)
+	t.Header["kid"] = l.Kid
+	return t.SignedString(l.Privada)
+}
+
+// keyfunc busca la llave pública por kid. Si no la conoce recarga (otra
+// réplica puede haber rotado recién), como mucho cada recargaMinimaLlaves.
+func (a *almacenLlaves) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("falta kid")
+	}
+	a.mu.RLock()
+	l, ok := a.llaves[kid]
+	puedeRecargar := time.Since(a.ultimaCarga) > recargaMinimaLlaves
+	a.mu.RUnlock()
+	if !ok && puedeRecargar {
+		if err := a.recargar(); err != nil {
+			log.Println("❌ Error recargando llaves JWT:", err)
+		}
+		a.mu.RLock()
+		l, ok = a.llaves[kid]
+		a.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("kid desconocido %q", kid)
+	}
+	if t.Method.Alg() != l.Metodo.Alg() {
+		return nil, errors.New("algoritmo inválido")
+	}
+	return l.Publica, nil
+}
+
+func b64url(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (a *almacenLlaves) jwks() []gin.H {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	keys := make([]gin.H, 0, len(a.llaves))
+	for _, l := range a.llaves {
+		switch pub := l.Publica.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "RSA", "use": "sig", "alg": l.Metodo.Alg(), "kid": l.Kid,
+				"n": b64url(pub.N.Bytes()),
+				"e": b64url(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "OKP", "crv": "Ed25519", "use": "sig", "alg": l.Metodo.Alg(), "kid": l.Kid,
+				"x": b64url(pub),
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i]["kid"].(string) < keys[j]["kid"].(string) })
+	return keys
+}
+
+// ---- PEM ----
+
+func metodoDeLlave(pub crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("tipo de llave no soportado %T", pub)
+}
+
+func parsearLlavePEM(kid string, data []byte) (*llaveJWT, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM inválido")
+	}
+	l := &llaveJWT{Kid: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("tipo de llave no soportado %T", k)
+		}
+		l.Privada, l.Publica = signer, signer.Public()
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		l.Privada, l.Publica = k, k.Public()
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		l.Publica = k
+	default:
+		return nil, fmt.Errorf("bloque PEM no soportado %q", block.Type)
+	}
+	m, err := metodoDeLlave(l.Publica)
+	if err != nil {
+		return nil, err
+	}
+	l.Metodo = m
+	return l, nil
+}
+
+func generarLlavePEM(alg string) ([]byte, error) {
+	var k crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		k, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, k, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("JWT_ALG no soportado %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ---- Archivos ----
+
+func cargarLlavesDeArchivos(dir string) ([]*llaveJWT, string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, "", err
+	}
+	var llaves []*llaveJWT
+	activo := os.Getenv("JWT_ACTIVE_KID")
+	var masNueva time.Time
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, "", err
+		}
+		kid := strings.TrimSuffix(filepath.Base(p), ".pem")
+		l, err := parsearLlavePEM(kid, data)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", p, err)
+		}
+		if info, err := os.Stat(p); err == nil {
+			l.Creada = info.ModTime()
+		}
+		llaves = append(llaves, l)
+		if os.Getenv("JWT_ACTIVE_KID") == "" && l.Privada != nil && l.Creada.After(masNueva) {
+			activo, masNueva = kid, l.Creada
+		}
+	}
+	return llaves, activo, nil
+}
+
+// ---- Cifrado ----
+// En jwt_llaves.private_pem va "v1:" + base64(nonce || AES-256-GCM(PEM)), con
+// el kid como dato asociado para que no se pueda mover una llave de fila. La
+// clave AES es SHA-256(JWT_KEYS_SECRET). Las filas en claro de antes se
+// cifran al arrancar (cifrarLlavesViejas).
+
+const prefijoLlaveCifrada = "v1:"
+
+func secretoLlavesJWT() ([]byte, error) {
+	v := os.Getenv("JWT_KEYS_SECRET")
+	if len(v) < 32 {
+		return nil, errors.New("JWT_KEYS_SECRET no configurado (mínimo 32 caracteres)")
+	}
+	k := sha256.Sum256([]byte(v))
+	return k[:], nil
+}
+
+func aeadLlaves(secreto []byte) (cipher.AEAD, error) {
+	bloque, err := aes.NewCipher(secreto)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bloque)
+}
+
+func cifrarLlave(secreto []byte, kid string, privPEM []byte) (string, error) {
+	aead, err := aeadLlaves(secreto)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return prefijoLlaveCifrada + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, privPEM, []byte(kid))), nil
+}
+
+func descifrarLlave(secreto []byte, kid, guardada string) ([]byte, error) {
+	if !strings.HasPrefix(guardada, prefijoLlaveCifrada) {
+		return nil, errors.New("llave sin cifrar")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(guardada, prefijoLlaveCifrada))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := aeadLlaves(secreto)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("llave cifrada inválida")
+	}
+	privPEM, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(kid))
+	if err != nil {
+		return nil, errors.New("no se pudo descifrar (¿cambió JWT_KEYS_SECRET?)")
+	}
+	return privPEM, nil
+}
+
+// cifrarLlavesViejas cifra las llaves guardadas en claro antes de que
+// existiera JWT_KEYS_SECRET.
+func cifrarLlavesViejas() error {
+	secreto, err := secretoLlavesJWT()
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`SELECT kid, private_pem FROM jwt_llaves WHERE private_pem LIKE '-----BEGIN%'`)
+	if err != nil {
+		return err
+	}
+	claras := map[string]string{}
+	for rows.Next() {
+		var kid, privPEM string
+		if err := rows.Scan(&kid, &privPEM); err != nil {
+			rows.Close()
+			return err
+		}
+		claras[kid] = privPEM
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for kid, privPEM := range claras {
+		cifrada, err := cifrarLlave(secreto, kid, []byte(privPEM))
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE jwt_llaves SET private_pem = ? WHERE kid = ? AND private_pem = ?`, cifrada, kid, privPEM); err != nil {
+			return err
+		}
+	}
+	if len(claras) > 0 {
+		log.Printf("🔑 %d llaves JWT cifradas", len(claras))
+	}
+	return nil
+}
+
+// ---- Base de datos ----
+
+func jwtAlg() string {
+	if v := os.Getenv("JWT_ALG"); v != "" {
+		return v
+	}
+	return "EdDSA"
+}
+
+// cargarLlavesDeDB devuelve las llaves no retiradas; firma la más nueva que
+// ya llegó a su activa_desde (las posteriores solo se publican).
+func cargarLlavesDeDB() ([]*llaveJWT, string, error) {
+	secreto, err := secretoLlavesJWT()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	rows, err := db.Query(`
+		SELECT kid, private_pem, created_at, activa_desde
+		FROM jwt_llaves
+		WHERE retirar_at IS NULL OR retirar_at > ?
+		ORDER BY activa_desde`, now)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var (
+		llaves []*llaveJWT
+		activo string
+	)
+	for rows.Next() {
+		var (
+			kid, guardada  string
+			creada, activa time.Time
+		)
+		if err := rows.Scan(&kid, &guardada, &creada, &activa); err != nil {
+			return nil, "", err
+		}
+		privPEM, err := descifrarLlave(secreto, kid, guardada)
+		if err != nil {
+			return nil, "", fmt.Errorf("llave %s: %w", kid, err)
+		}
+		l, err := parsearLlavePEM(kid, privPEM)
+		if err != nil {
+			return nil, "", fmt.Errorf("llave %s: %w", kid, err)
+		}
+		l.Creada = creada
+		llaves = append(llaves, l)
+		if !activa.After(now) {
+			activo = kid
+		}
+	}
+	return llaves, activo, rows.Err()
+}
+
+// rotarLlaveDB crea una llave nueva si la última es más vieja que intervalo.
+// Empieza a firmar anticipoLlaveNueva después (salvo la primera, que no
+// reemplaza a nadie) y las anteriores siguen sirviendo para verificar hasta
+// que vence el último access token que pudieron firmar. GET_LOCK evita que
+// dos réplicas roten a la vez.
+func rotarLlaveDB(intervalo time.Duration) (bool, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var lock sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK('jwt_rotacion', 5)`).Scan(&lock); err != nil {
+		return false, err
+	}
+	if lock.Int64 != 1 {
+		return false, nil
+	}
+	defer conn.ExecContext(ctx, `SELECT RELEASE_LOCK('jwt_rotacion')`)
+
+	var ultima sql.NullTime
+	if err := conn.QueryRowContext(ctx, `SELECT MAX(created_at) FROM jwt_llaves WHERE retirar_at IS NULL`).Scan(&ultima); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if ultima.Valid && now.Sub(ultima.Time) < intervalo {
+		return false, nil
+	}
+
+	activa := now
+	if ultima.Valid {
+		activa = now.Add(anticipoLlaveNueva)
+	}
+	secreto, err := secretoLlavesJWT()
+	if err != nil {
+		return false, err
+	}
+	privPEM, err := generarLlavePEM(jwtAlg())
+	if err != nil {
+		return false, err
+	}
+	kid, err := randomToken(12)
+	if err != nil {
+		return false, err
+	}
+	cifrada, err := cifrarLlave(secreto, kid, privPEM)
+	if err != nil {
+		return false, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE jwt_llaves SET retirar_at = ? WHERE retirar_at IS NULL`,
+		activa.Add(accessTokenTTL()+time.Hour)); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO jwt_llaves (kid, alg, private_pem, created_at, activa_desde) VALUES (?, ?, ?, ?, ?)`,
+		kid, jwtAlg(), cifrada, now, activa); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// iniciarLlavesJWT carga las llaves al arrancar y deja una goroutine que las
+// recarga (y rota, si vienen de la base) periódicamente.
+func iniciarLlavesJWT() {
+	intervalo := duracionEnv("JWT_ROTATION_INTERVAL", 30*24*time.Hour)
+	desdeDB := os.Getenv("JWT_KEYS_SOURCE") != "file"
+
+	if desdeDB {
+		llavesJWT.recargarFunc = cargarLlavesDeDB
+		if err := cifrarLlavesViejas(); err != nil {
+			log.Fatal("❌ Error cifrando llaves JWT: ", err)
+		}
+		if _, err := rotarLlaveDB(intervalo); err != nil {
+			log.Fatal("❌ Error generando llave JWT: ", err)
+		}
+	} else {
+		dir := os.Getenv("JWT_KEYS_DIR")
+		if dir == "" {
+			log.Fatal("❌ JWT_KEYS_DIR no configurado")
+		}
+		llavesJWT.recargarFunc = func() ([]*llaveJWT, string, error) { return cargarLlavesDeArchivos(dir) }
+	}
+	if err := llavesJWT.recargar(); err != nil {
+		log.Fatal("❌ Error cargando llaves JWT: ", err)
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if desdeDB {
+				rotada, err := rotarLlaveDB(intervalo)
+				if err != nil {
+					log.Println("❌ Error rotando llave JWT:", err)
+				} else if rotada {
+					log.Println("🔑 Llave JWT rotada")
+				}
+			}
+			if err := llavesJWT.recargar(); err != nil {
+				log.Println("❌ Error recargando llaves JWT:", err)
+			}
+		}
+	}()
+}
+
+func registrarRutasJWKS(r *gin.Engine) {
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+		c.JSON(http.StatusOK, gin.H{"keys": llavesJWT.jwks()})
+	})
+}
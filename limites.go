@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- LÍMITES DE INTENTOS (fuerza bruta) -------------
+// Ventana deslizante por clave (IP o email). Pasados SinDemora intentos cada
+// intento nuevo tiene que esperar el doble que el anterior; al llegar a
+// Bloqueo la clave queda bloqueada DuracionBloqueo desde el último intento.
+// RATE_LIMIT_STORE=memory usa un store local (un solo nodo); por defecto MySQL
+// para que el límite se comparta entre réplicas.
+
+// Limitador guarda los intentos que cuentan contra el límite de cada clave
+// (logins fallidos, registros, pedidos de recupero).
+type Limitador interface {
+	// Intentar controla la política y, si no hay que esperar, anota el
+	// intento en la misma operación: una ráfaga de pedidos en paralelo no
+	// puede pasar todo el control antes de que se anote el primero. Devuelve
+	// cuánto falta para poder intentar (0 si se anotó).
+	Intentar(clave string, p politicaLimite) (time.Duration, error)
+	// Devolver quita el último intento anotado para clave (p.ej. el login
+	// salió bien y no tiene que contar).
+	Devolver(clave string) error
+	// Limpiar borra los intentos de clave (p.ej. tras un login correcto).
+	Limpiar(clave string) error
+}
+
+type politicaLimite struct {
+	Ventana         time.Duration
+	SinDemora       int
+	Bloqueo         int
+	DuracionBloqueo time.Duration
+}
+
+var (
+	limiteLoginEmail = politicaLimite{Ventana: 15 * time.Minute, SinDemora: 3, Bloqueo: 10, DuracionBloqueo: 15 * time.Minute}
+	limiteLoginIP    = politicaLimite{Ventana: 15 * time.Minute, SinDemora: 10, Bloqueo: 50, DuracionBloqueo: 15 * time.Minute}
+	limiteRegistroIP = politicaLimite{Ventana: time.Hour, SinDemora: 5, Bloqueo: 20, DuracionBloqueo: time.Hour}
+	limite2FAUsuario = politicaLimite{Ventana: 15 * time.Minute, SinDemora: 3, Bloqueo: 10, DuracionBloqueo: 15 * time.Minute}
+	limite2FAIP      = politicaLimite{Ventana: 15 * time.Minute, SinDemora: 10, Bloqueo: 50, DuracionBloqueo: 15 * time.Minute}
+	limiteRecupero   = politicaLimite{Ventana: time.Hour, SinDemora: 3, Bloqueo: 10, DuracionBloqueo: time.Hour}
+)
+
+// los intentos más viejos que esto no cuentan para ninguna política
+const retencionIntentos = 24 * time.Hour
+
+const demoraMaxima = 5 * time.Minute
+
+var limitador Limitador
+
+func nuevoLimitadorDesdeEnv() Limitador {
+	if os.Getenv("RATE_LIMIT_STORE") == "memory" {
+		return &LimitadorMemoria{intentos: map[string][]time.Time{}}
+	}
+	return LimitadorMySQL{}
+}
+
+// espera devuelve cuánto falta para permitir otro intento (0 si se puede).
+func (p politicaLimite) espera(intentos int, ultimo, ahora time.Time) time.Duration {
+	var hasta time.Time
+	switch {
+	case intentos >= p.Bloqueo:
+		hasta = ultimo.Add(p.DuracionBloqueo)
+	case intentos > p.SinDemora:
+		demora := time.Second << uint(intentos-p.SinDemora-1)
+		if demora > demoraMaxima {
+			demora = demoraMaxima
+		}
+		hasta = ultimo.Add(demora)
+	default:
+		return 0
+	}
+	if d := hasta.Sub(ahora); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// controlarLimite anota un intento para la clave o corta la request con 429
+// si tiene que esperar.
+func controlarLimite(c *gin.Context, clave string, p politicaLimite) bool {
+	d, err := limitador.Intentar(clave, p)
+	if err != nil {
+		dbErr(c, err)
+		return false
+	}
+	if d > 0 {
+		segundos := int(d.Seconds() + 0.999)
+		c.Header("Retry-After", strconv.Itoa(segundos))
+		errores.Responder(c, errores.Nuevo(errores.DemasiadosIntentos).Con("retry_after", segundos))
+		return false
+	}
+	return true
+}
+
+// configurarProxies define de quién se acepta X-Forwarded-For para
+// c.ClientIP(), que es la clave de los límites por IP; sin esto gin le cree
+// a cualquiera y el límite se saltea rotando el header.
+//
+//	TRUSTED_PROXIES=10.0.0.0/8,192.168.1.10   IPs o CIDR (vacío: ninguno,
+//	                                          vale la IP de la conexión)
+//	TRUSTED_PLATFORM=cloudflare|google|flyio  o el header que pone la plataforma
+func configurarProxies(r *gin.Engine) error {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+	switch p := strings.TrimSpace(os.Getenv("TRUSTED_PLATFORM")); strings.ToLower(p) {
+	case "":
+	case "cloudflare":
+		r.TrustedPlatform = gin.PlatformCloudflare
+	case "google":
+		r.TrustedPlatform = gin.PlatformGoogleAppEngine
+	case "flyio":
+		r.TrustedPlatform = gin.PlatformFlyIO
+	default:
+		r.TrustedPlatform = p
+	}
+	return nil
+}
+
+func claveLimite(accion, tipo, valor string) string {
+	valor = strings.ToLower(strings.TrimSpace(valor))
+	if len(valor) > 128 {
+		valor = hashToken(valor)
+	}
+	return fmt.Sprintf("%s:%s:%s", accion, tipo, valor)
+}
+
+// limpiarIntentosLogin perdona los intentos de un login que terminó bien:
+// borra los del email y devuelve el de la IP.
+func limpiarIntentosLogin(email, ip string) {
+	if err := limitador.Limpiar(claveLimite("login", "email", email)); err != nil {
+		log.Println("❌ Error limpiando intentos:", err)
+	}
+	if err := limitador.Devolver(claveLimite("login", "ip", ip)); err != nil {
+		log.Println("❌ Error devolviendo intento:", err)
+	}
+}
+
+// ---- MySQL ----
+
+// LimitadorMySQL serializa los intentos de una misma clave con el lock de
+// su fila en intentos_auth_claves (el upsert la bloquea hasta el commit).
+type LimitadorMySQL struct{}
+
+func (LimitadorMySQL) Intentar(clave string, p politicaLimite) (time.Duration, error) {
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO intentos_auth_claves (clave, actualizado_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE actualizado_at = VALUES(actualizado_at)`, clave, now); err != nil {
+		return 0, err
+	}
+	var (
+		n      int
+		ultimo *time.Time
+	)
+	if err := tx.QueryRow(`
+		SELECT COUNT(1), MAX(ts) FROM intentos_auth
+		WHERE clave = ? AND ts > ?`, clave, now.Add(-p.Ventana),
+	).Scan(&n, &ultimo); err != nil {
+		return 0, err
+	}
+	if ultimo != nil {
+		if d := p.espera(n, *ultimo, now); d > 0 {
+			return d, nil
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO intentos_auth (clave, ts) VALUES (?, ?)`, clave, now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	// limpieza incremental de intentos vencidos
+	if _, err := db.Exec(`DELETE FROM intentos_auth WHERE ts < ? LIMIT 100`, now.Add(-retencionIntentos)); err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(`DELETE FROM intentos_auth_claves WHERE actualizado_at < ? LIMIT 100`, now.Add(-retencionIntentos))
+	return 0, err
+}
+
+func (LimitadorMySQL) Devolver(clave string) error {
+	_, err := db.Exec(`DELETE FROM intentos_auth WHERE clave = ? ORDER BY ts DESC LIMIT 1`, clave)
+	return err
+}
+
+func (LimitadorMySQL) Limpiar(clave string) error {
+	_, err := db.Exec(`DELETE FROM intentos_auth WHERE clave = ?`, clave)
+	return err
+}
+
+// ---- Memoria ----
+
+type LimitadorMemoria struct {
+	mu       sync.Mutex
+	intentos map[string][]time.Time
+	escritos int
+}
+
+func podarIntentos(ts []time.Time, desde time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && !ts[i].After(desde) {
+		i++
+	}
+	return ts[i:]
+}
+
+func (l *LimitadorMemoria) Intentar(clave string, p politicaLimite) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	ts := podarIntentos(l.intentos[clave], now.Add(-retencionIntentos))
+	if enVentana := podarIntentos(ts, now.Add(-p.Ventana)); len(enVentana) > 0 {
+		if d := p.espera(len(enVentana), enVentana[len(enVentana)-1], now); d > 0 {
+			return d, nil
+		}
+	}
+	l.intentos[clave] = append(ts, now)
+
+	// cada tanto se barre el mapa entero para no acumular claves viejas
+	l.escritos++
+	if l.escritos%1000 == 0 {
+		for k, ts := range l.intentos {
+			if ts = podarIntentos(ts, now.Add(-retencionIntentos)); len(ts) == 0 {
+				delete(l.intentos, k)
+			} else {
+				l.intentos[k] = ts
+			}
+		}
+	}
+	return 0, nil
+}
+
+func (l *LimitadorMemoria) Devolver(clave string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ts := l.intentos[clave]; len(ts) > 0 {
+		l.intentos[clave] = ts[:len(ts)-1]
+	}
+	return nil
+}
+
+func (l *LimitadorMemoria) Limpiar(clave string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.intentos, clave)
+	return nil
+}
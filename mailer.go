@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------- MAILER -------------
+// MAILER=smtp|file|memory. Sin MAILER: smtp si hay SMTP_HOST, si no file.
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+// SMTPMailer envía por SMTP con auth PLAIN (SMTP_HOST, SMTP_PORT, SMTP_USER,
+// SMTP_PASS, SMTP_FROM).
+type SMTPMailer struct {
+	Host string
+	Port string
+	User string
+	Pass string
+	From string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	var auth smtp.Auth
+	if m.User != "" {
+		auth = smtp.PlainAuth("", m.User, m.Pass, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// MensajeMail es un mail guardado por MemoryMailer.
+type MensajeMail struct {
+	To      string
+	Subject string
+	Body    string
+	Fecha   time.Time
+}
+
+// MemoryMailer guarda los mails en memoria (tests).
+type MemoryMailer struct {
+	mu       sync.Mutex
+	Mensajes []MensajeMail
+}
+
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Mensajes = append(m.Mensajes, MensajeMail{To: to, Subject: subject, Body: body, Fecha: time.Now()})
+	return nil
+}
+
+// Ultimo devuelve el último mail enviado a to.
+func (m *MemoryMailer) Ultimo(to string) (MensajeMail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.Mensajes) - 1; i >= 0; i-- {
+		if m.Mensajes[i].To == to {
+			return m.Mensajes[i], true
+		}
+	}
+	return MensajeMail{}, false
+}
+
+// FileMailer escribe cada mail como .eml en Dir (desarrollo local).
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(to))
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", to, subject, body)
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0o644)
+}
+
+func nuevoMailerDesdeEnv() Mailer {
+	tipo := os.Getenv("MAILER")
+	if tipo == "" {
+		tipo = "file"
+		if os.Getenv("SMTP_HOST") != "" {
+			tipo = "smtp"
+		}
+	}
+	switch tipo {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return SMTPMailer{
+			Host: os.Getenv("SMTP_HOST"),
+			Port: port,
+			User: os.Getenv("SMTP_USER"),
+			Pass: os.Getenv("SMTP_PASS"),
+			From: os.Getenv("SMTP_FROM"),
+		}
+	case "memory":
+		return &MemoryMailer{}
+	default:
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mails"
+		}
+		log.Println("📨 Mailer de archivos en", dir)
+		return FileMailer{Dir: dir}
+	}
+}
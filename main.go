@@ -2,18 +2,22 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
+
+	"proyecto-parking-back/errores"
 )
 
 var db *sql.DB
@@ -38,103 +42,111 @@ func conectarDB() {
 }
 
 // ----------- TIPOS -------------
+// Las reglas de validación están en los tags binding (ver validacion.go).
 type DiaAtencion struct {
-	Dia   string `json:"dia"`
-	Desde string `json:"desde"`
-	Hasta string `json:"hasta"`
+	Dia   string `json:"dia" binding:"required,dia"`
+	Desde string `json:"desde" binding:"required,hora"`
+	Hasta string `json:"hasta" binding:"required,hora"`
 }
 
 type EstacionamientoNuevo struct {
 	DuenioID      int           `json:"duenio_id"`
-	Nombre        string        `json:"nombre"`
-	Cantidad      int           `json:"cantidad"`
-	Latitud       float64       `json:"latitud"`
-	Longitud      float64       `json:"longitud"`
-	PrecioPorHora *float64      `json:"precio_por_hora"`
-	Techado       *string       `json:"techado"`
-	Seguridad     []string      `json:"seguridad"`
+	Nombre        string        `json:"nombre" binding:"required,novacio,max=100"`
+	Cantidad      int           `json:"cantidad" binding:"required,min=1,max=2000"` // maxLugares
+	Latitud       float64       `json:"latitud" binding:"min=-90,max=90"`
+	Longitud      float64       `json:"longitud" binding:"min=-180,max=180"`
+	PrecioPorHora *float64      `json:"precio_por_hora" binding:"omitempty,min=0"`
+	Techado       *string       `json:"techado" binding:"omitempty,oneof=si no parcial"`
+	Seguridad     []string      `json:"seguridad" binding:"omitempty,dive,oneof=camaras vigilante"`
 	Banos         *bool         `json:"banos"`
-	AlturaMaxM    *float64      `json:"altura_max_m"`
-	Dias          []DiaAtencion `json:"dias"`
+	AlturaMaxM    *float64      `json:"altura_max_m" binding:"omitempty,gt=0,max=10"`
+	Dias          []DiaAtencion `json:"dias" binding:"omitempty,max=21,dive"`
 }
 
 type ActualizacionLugar struct {
-	EstacionamientoID int    `json:"estacionamiento_id"`
+	EstacionamientoID int    `json:"estacionamiento_id" binding:"required,min=1"`
 	DuenioID          int    `json:"duenio_id"`
-	Cantidad          int    `json:"cantidad"`
+	Cantidad          int    `json:"cantidad" binding:"required,min=1,max=2000"` // maxLugares
 	Estado            string `json:"estado"`
 }
 
 type EstadoLugar struct {
-	EstacionamientoID int  `json:"estacionamiento_id"`
-	Numero            int  `json:"numero"`
+	EstacionamientoID int  `json:"estacionamiento_id" binding:"required,min=1"`
+	Numero            int  `json:"numero" binding:"required,min=1"`
 	Ocupado           bool `json:"ocupado"`
 }
 
 type LugarSimple struct {
-	Numero  int  `json:"numero"`
-	Ocupado bool `json:"ocupado"`
+	Numero    int  `json:"numero"`
+	Ocupado   bool `json:"ocupado"`
+	Reservado bool `json:"reservado"`
 }
 
 // ==== AUTH TYPES ====
 type RegisterRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"required,email,max=255"`
+	Password string `json:"password" binding:"required,password"`
 }
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 type User struct {
-	ID           int
-	Email        string
-	PasswordHash string
-	Vip          bool
+	ID              int
+	Email           string
+	PasswordHash    string
+	Vip             bool
+	EmailVerificado bool
 }
 
 // ----------- HELPERS -------------
+
+// dbErr corta la request con un error interno; el detalle solo va al log.
 func dbErr(c *gin.Context, err error) {
-	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	errores.Responder(c, errores.Envolver(err))
+}
+
+// fallar corta la request con el error de codigo (ver errores.Middleware).
+func fallar(c *gin.Context, codigo errores.Codigo) {
+	errores.Responder(c, errores.Nuevo(codigo))
 }
 
+// esDuplicado indica si err es una violación de clave única de MySQL.
+func esDuplicado(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}
+
+// hash contra el que se compara cuando el email no existe
+var hashFalso, _ = bcrypt.GenerateFromPassword([]byte("password-inexistente"), bcrypt.DefaultCost)
+
 // ========= MIDDLEWARE (leer user_id desde el JWT) =========
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := strings.TrimSpace(c.GetHeader("Authorization"))
 		if auth == "" || !strings.HasPrefix(strings.ToLower(auth), "bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token no enviado"})
+			fallar(c, errores.TokenFaltante)
 			return
 		}
 		tokenString := strings.TrimSpace(auth[len("Bearer "):])
 
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			log.Println("❌ JWT_SECRET no configurado")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "JWT no configurado"})
-			return
-		}
-
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("algoritmo inválido")
-			}
-			return []byte(secret), nil
-		})
+		token, err := jwt.Parse(tokenString, llavesJWT.keyfunc,
+			jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}))
 		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token inválido"})
+			fallar(c, errores.TokenInvalido)
 			return
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Claims inválidos"})
+			fallar(c, errores.TokenInvalido)
 			return
 		}
 
 		// exp
 		if exp, ok := claims["exp"].(float64); ok {
 			if time.Now().Unix() > int64(exp) {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expirado"})
+				fallar(c, errores.TokenExpirado)
 				return
 			}
 		}
@@ -160,49 +172,75 @@ func AuthMiddleware() gin.HandlerFunc {
 			}
 		}
 		if uid == 0 {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Falta user_id/sub en token"})
+			fallar(c, errores.TokenInvalido)
+			return
+		}
+
+		// sesión (sid) y jti: permiten revocar tokens antes de su exp
+		sid, _ := claims["sid"].(string)
+		jti, _ := claims["jti"].(string)
+		if sid == "" || jti == "" {
+			fallar(c, errores.TokenInvalido)
+			return
+		}
+		vigente, err := sesionVigente(sid, jti)
+		if err != nil {
+			dbErr(c, err)
+			c.Abort()
+			return
+		}
+		if !vigente {
+			fallar(c, errores.SesionRevocada)
 			return
 		}
 
 		c.Set("userID", uid)
+		c.Set("roles", claimStrings(claims["roles"]))
+		c.Set("permisos", claimStrings(claims["permisos"]))
+		c.Set("sessionID", sid)
+		c.Set("jti", jti)
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			c.Set("tokenExp", exp.Time)
+		}
 		c.Next()
 	}
 }
 
-func ownsEstacionamiento(estID, userID int) bool {
-	var n int
-	err := db.QueryRow(`SELECT COUNT(1) FROM estacionamientos WHERE id=? AND duenio_id=?`, estID, userID).Scan(&n)
-	return err == nil && n > 0
-}
-
-// —— VIP & Reservas helpers ——
-func userIsVIP(userID int) (bool, error) {
-	var vip int
-	err := db.QueryRow(`SELECT vip FROM usuarios WHERE id=?`, userID).Scan(&vip)
-	return vip == 1, err
-}
-
-func hasActiveReservation(userID, estID int) (bool, error) {
-	var cnt int
-	err := db.QueryRow(`
-		SELECT COUNT(1)
-		FROM reservas
-		WHERE user_id=? AND estacionamiento_id=? AND status=1
-	`, userID, estID).Scan(&cnt)
-	return cnt > 0, err
+func claimStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, it := range list {
+		if s, ok := it.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
 }
 
 // ----------- MAIN ------------
 func main() {
 	conectarDB()
 	defer db.Close()
+	asegurarEsquema()
+	mailer = nuevoMailerDesdeEnv()
+	limitador = nuevoLimitadorDesdeEnv()
+	iniciarLlavesJWT()
+	iniciarVencimientoReservas()
+	iniciarLimpiezaJTI()
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+	if err := configurarProxies(r); err != nil {
+		log.Fatal("❌ TRUSTED_PROXIES inválido: ", err)
+	}
+
+	// errores con código, mensaje traducido e id de correlación
+	r.Use(errores.Middleware())
 
 	// CORS simple
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Accept-Language, X-Api-Key, X-Request-ID")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(200)
@@ -216,17 +254,21 @@ func main() {
 		var payload RegisterRequest
 		fmt.Println("👉 Se llamó a /register")
 
-		if err := c.BindJSON(&payload); err != nil {
-			fmt.Println("❌ Error al parsear JSON:", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
+		if !bindJSON(c, &payload) {
+			fmt.Println("❌ Payload de registro inválido")
+			return
+		}
+		payload.Email = normalizarEmail(payload.Email)
+		fmt.Println("📥 Registro recibido:", payload.Email)
+
+		if !controlarLimite(c, claveLimite("registro", "ip", c.ClientIP()), limiteRegistroIP) {
 			return
 		}
-		fmt.Println("📥 Payload recibido:", payload)
 
 		hash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
 		if err != nil {
 			fmt.Println("❌ Error al generar hash:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "hash error"})
+			fallar(c, errores.Interno)
 			return
 		}
 
@@ -234,142 +276,163 @@ func main() {
 			`INSERT INTO usuarios (email, password_hash) VALUES (?,?)`,
 			payload.Email, string(hash),
 		)
+		// misma respuesta exista o no el email, para no permitir enumerar cuentas
+		respuesta := gin.H{"mensaje": "Te enviamos un mail para confirmar la cuenta", "email": payload.Email}
+		if esDuplicado(err) {
+			fmt.Println("⚠️ Registro con email existente")
+			enviarMail(payload.Email, "Intento de registro",
+				"Alguien intentó crear una cuenta con este email, que ya está registrado.\n\n"+
+					"Si fuiste vos y no recordás la contraseña, podés recuperarla desde "+appURL()+"/reset-password")
+			c.JSON(http.StatusOK, respuesta)
+			return
+		}
 		if err != nil {
 			fmt.Println("❌ Error al insertar en DB:", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Email ya registrado"})
+			dbErr(c, err)
 			return
 		}
 
 		id, _ := res.LastInsertId()
 		fmt.Println("✅ Usuario registrado con ID:", id)
-		c.JSON(http.StatusOK, gin.H{"id": id, "email": payload.Email})
+		if err := enviarVerificacionEmail(int(id), payload.Email); err != nil {
+			fmt.Println("❌ Error al generar verificación de email:", err)
+		}
+		c.JSON(http.StatusOK, respuesta)
 	})
 
 	r.POST("/login", func(c *gin.Context) {
-		fmt.Println("🛠 JWT_SECRET en runtime (Railway):", os.Getenv("JWT_SECRET"))
 		fmt.Println("👉 Se llamó a /login")
 
 		var payload LoginRequest
-		if err := c.BindJSON(&payload); err != nil {
+		if err := c.ShouldBindJSON(&payload); err != nil {
 			fmt.Println("❌ Error al parsear JSON:", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		payload.Email = normalizarEmail(payload.Email)
+		fmt.Println("📥 Login recibido:", payload.Email)
+
+		// el intento se anota antes de mirar la contraseña (ver limites.go) y
+		// se devuelve si el login termina bien (con 2FA, al pasar el segundo
+		// factor): solo cuentan los fallidos
+		claveIP := claveLimite("login", "ip", c.ClientIP())
+		claveEmail := claveLimite("login", "email", payload.Email)
+		if !controlarLimite(c, claveIP, limiteLoginIP) {
+			return
+		}
+		if !controlarLimite(c, claveEmail, limiteLoginEmail) {
+			if err := limitador.Devolver(claveIP); err != nil {
+				fmt.Println("❌ Error devolviendo intento:", err)
+			}
 			return
 		}
-		fmt.Println("📥 Payload login recibido:", payload)
 
 		var u User
-		var vipInt int
-		err := db.QueryRow(`SELECT id, email, password_hash, vip FROM usuarios WHERE email = ?`, payload.Email).
-			Scan(&u.ID, &u.Email, &u.PasswordHash, &vipInt)
+		var vipInt, verificadoInt int
+		err := db.QueryRow(`SELECT id, email, password_hash, vip, email_verificado FROM usuarios WHERE email = ?`, payload.Email).
+			Scan(&u.ID, &u.Email, &u.PasswordHash, &vipInt, &verificadoInt)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Credenciales inválidas"})
+			// se compara igual contra un hash falso para que el tiempo de
+			// respuesta no delate si el email existe
+			_ = bcrypt.CompareHashAndPassword(hashFalso, []byte(payload.Password))
+			fallar(c, errores.CredencialesInvalidas)
 			return
 		}
 		u.Vip = vipInt == 1
+		u.EmailVerificado = verificadoInt == 1
 
-		fmt.Println("🔎 Usuario encontrado:", u.Email, "hash:", u.PasswordHash)
+		fmt.Println("🔎 Usuario encontrado:", u.Email)
 
 		if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(payload.Password)); err != nil {
 			fmt.Println("❌ La contraseña no coincide:", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Credenciales inválidas"})
+			fallar(c, errores.CredencialesInvalidas)
 			return
 		}
 
-		fmt.Println("✅ Password correcta, generando token...")
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			fmt.Println("❌ JWT_SECRET no definido")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "JWT no configurado"})
+		if requiereEmailVerificado() && !u.EmailVerificado {
+			fallar(c, errores.EmailNoVerificado)
 			return
 		}
 
-		claims := jwt.MapClaims{
-			"user_id": u.ID,
-			"email":   u.Email,
-			"vip":     u.Vip,
-			"exp":     time.Now().Add(24 * time.Hour).Unix(),
+		desafio, requiere, err := desafio2FA(u)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if requiere {
+			fmt.Println("🔐 Login requiere 2FA, user_id:", u.ID)
+			c.JSON(http.StatusOK, desafio)
+			return
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		signed, err := token.SignedString([]byte(secret))
+
+		// recién con el login completo (sin 2FA pendiente) se perdonan los
+		// intentos; con 2FA lo hace /login/2fa
+		limpiarIntentosLogin(u.Email, c.ClientIP())
+
+		fmt.Println("✅ Password correcta, generando token...")
+		sid, refresh, err := crearSesion(u.ID, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		resp, err := respuestaTokens(u, sid, refresh)
 		if err != nil {
 			fmt.Println("❌ Error al firmar token:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token error"})
+			fallar(c, errores.Interno)
 			return
 		}
 
-		fmt.Println("✅ Login exitoso, token:", signed)
-		c.JSON(http.StatusOK, gin.H{
-			"token":   signed,
-			"user_id": u.ID,
-			"vip":     u.Vip,
-		})
-
+		fmt.Println("✅ Login exitoso, user_id:", u.ID)
+		c.JSON(http.StatusOK, resp)
 	})
 
+	registrarValidaciones()
+	registrarRutasSesiones(r)
+	registrarRutasJWKS(r)
+	registrarRutasRoles(r)
+	registrarRutasStaff(r)
+	registrarRutasVerificacion(r)
+	registrarRutasDosFactores(r)
+	registrarRutasDispositivos(r)
+	registrarRutasPerfil(r)
+	registrarRutasVehiculos(r)
+	registrarRutasEstacionamientos(r)
+	registrarRutasBusqueda(r)
+	registrarRutasExcepciones(r)
+	registrarRutasTarifas(r)
+	registrarRutasReservas(r)
+	registrarRutasEstadosReserva(r)
+	registrarRutasListadoReservas(r)
+
 	// ============= 🚗 ESTACIONAMIENTOS ==============
 	// Crear estacionamiento (protegido)
 	r.POST("/estacionamientos", AuthMiddleware(), func(c *gin.Context) {
 		var in EstacionamientoNuevo
-		if err := c.BindJSON(&in); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
+		if !bindJSON(c, &in) {
 			return
 		}
 
 		uidVal, exists := c.Get("userID")
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Sin usuario"})
+			fallar(c, errores.NoAutenticado)
 			return
 		}
 		duenioID, ok := uidVal.(int)
 		if !ok || duenioID == 0 {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "userID inválido"})
+			fallar(c, errores.NoAutenticado)
 			return
 		}
 
-		// Normalizar seguridad
-		seg := ""
-		if len(in.Seguridad) > 0 {
-			allowed := map[string]bool{"camaras": true, "vigilante": true}
-			out := make([]string, 0, len(in.Seguridad))
-			for _, v := range in.Seguridad {
-				if allowed[v] {
-					out = append(out, v)
-				}
-			}
-			if len(out) > 0 {
-				seg = strings.Join(out, ",")
-			}
-		}
-
-		// Normalizar baños
-		banos := 0
-		if in.Banos != nil && *in.Banos {
-			banos = 1
-		}
-
-		// Insert principal
-		res, err := db.Exec(`
-			INSERT INTO estacionamientos
-			  (duenio_id, nombre, cantidad, latitud, longitud,
-			   precio_por_hora, techado, seguridad, banos, altura_max_m)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			duenioID, in.Nombre, in.Cantidad, in.Latitud, in.Longitud,
-			in.PrecioPorHora, in.Techado, seg, banos, in.AlturaMaxM,
-		)
+		nuevoID, err := crearEstacionamiento(duenioID, in)
 		if err != nil {
+			var ec *errorCampo
+			if errors.As(err, &ec) {
+				errores.Responder(c, errores.Envolver(ec.Err).Con("campo", ec.Campo))
+				return
+			}
 			dbErr(c, err)
 			return
 		}
-		nuevoID, _ := res.LastInsertId()
-
-		// Insert días (si vienen)
-		for _, dia := range in.Dias {
-			_, _ = db.Exec(
-				`INSERT INTO dias_atencion (estacionamiento_id, dia, desde, hasta)
-         VALUES (?, ?, ?, ?)`,
-				nuevoID, dia.Dia, dia.Desde, dia.Hasta,
-			)
-		}
 
 		c.JSON(http.StatusCreated, gin.H{"id": nuevoID})
 	})
@@ -378,7 +441,7 @@ func main() {
 	r.GET("/mis-estacionamientos", AuthMiddleware(), func(c *gin.Context) {
 		uidVal, exists := c.Get("userID")
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Sin usuario"})
+			fallar(c, errores.NoAutenticado)
 			return
 		}
 		userID := uidVal.(int)
@@ -386,7 +449,7 @@ func main() {
 		rows, err := db.Query(`
 			SELECT id, nombre, cantidad, latitud, longitud
 			FROM estacionamientos
-			WHERE duenio_id = ?`, userID)
+			WHERE duenio_id = ? AND eliminado_at IS NULL`, userID)
 		if err != nil {
 			dbErr(c, err)
 			return
@@ -412,54 +475,37 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"estacionamientos": list})
 	})
 
-	// Crear/Actualizar lugares (protegido + check de dueño)
-	r.POST("/lugares", AuthMiddleware(), func(c *gin.Context) {
+	// Cambiar la capacidad (protegido + permiso sobre el estacionamiento).
+	// Agrega o quita lugares al final sin tocar el estado de los demás.
+	r.POST("/lugares", AuthMiddleware(), RequirePermissionEn(estIDBody, permLugaresEditar), func(c *gin.Context) {
 		var req ActualizacionLugar
-		if err := c.BindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
-			return
-		}
-
-		uidVal, _ := c.Get("userID")
-		userID := uidVal.(int)
-
-		if !ownsEstacionamiento(req.EstacionamientoID, userID) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "No sos dueño del estacionamiento"})
+		if !bindJSON(c, &req) {
 			return
 		}
 
-		for i := 1; i <= req.Cantidad; i++ {
-			_, _ = db.Exec(`
-        INSERT INTO lugares (estacionamiento_id, numero, ocupado)
-        VALUES (?, ?, ?)
-        ON DUPLICATE KEY UPDATE ocupado = VALUES(ocupado)`,
-				req.EstacionamientoID, i, false,
-			)
-		}
-		c.JSON(http.StatusOK, gin.H{"mensaje": "OK"})
-	})
-
-	// Cambiar estado de un lugar (protegido + check de dueño)
-	r.POST("/lugares/estado", AuthMiddleware(), func(c *gin.Context) {
-		var in EstadoLugar
-		if err := c.ShouldBindJSON(&in); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
 			return
 		}
-
-		uidVal, ok := c.Get("userID")
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Sin usuario"})
+		defer tx.Rollback()
+		if err := cambiarCapacidad(tx, req.EstacionamientoID, req.Cantidad); err != nil {
+			if !errorCapacidadJSON(c, err) {
+				dbErr(c, err)
+			}
 			return
 		}
-		userID, ok := uidVal.(int)
-		if !ok || userID == 0 {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "userID inválido"})
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"mensaje": "OK", "cantidad": req.Cantidad})
+	})
 
-		if !ownsEstacionamiento(in.EstacionamientoID, userID) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "No sos dueño del estacionamiento"})
+	// Cambiar estado de un lugar (protegido + dueño o staff del estacionamiento)
+	r.POST("/lugares/estado", AuthMiddleware(), RequirePermissionEn(estIDBody, permLugaresEstado), func(c *gin.Context) {
+		var in EstadoLugar
+		if !bindJSON(c, &in) {
 			return
 		}
 
@@ -474,11 +520,32 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"mensaje": "OK"})
 	})
 
-	// Estado de lugares (público)
+	// Estado de lugares (público). reservado: tiene una reserva que cubre
+	// ahora; las reservas sin lugar asignado se descuentan de libres. Un
+	// estacionamiento dado de baja o inexistente responde 404.
 	r.GET("/estado/:id", func(c *gin.Context) {
-		id := c.Param("id")
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		if ok, err := estacionamientoActivo(id); err != nil || !ok {
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			fallar(c, errores.EstacionamientoNoEncontrado)
+			return
+		}
+		ahora := time.Now()
 		rows, err := db.Query(`
-			SELECT numero, ocupado FROM lugares WHERE estacionamiento_id=?`, id)
+			SELECT l.numero, l.ocupado,
+			       EXISTS (SELECT 1 FROM reservas r
+			               WHERE r.estacionamiento_id = l.estacionamiento_id AND r.numero = l.numero
+			                 AND r.status = 1 AND r.desde <= ? AND r.hasta > ?)
+			FROM lugares l
+			JOIN estacionamientos e ON e.id = l.estacionamiento_id AND e.eliminado_at IS NULL
+			WHERE l.estacionamiento_id=?`, ahora, ahora, id)
 		if err != nil {
 			dbErr(c, err)
 			return
@@ -486,47 +553,26 @@ func main() {
 		defer rows.Close()
 
 		var lug []LugarSimple
+		libres := 0
 		for rows.Next() {
 			var l LugarSimple
-			if err := rows.Scan(&l.Numero, &l.Ocupado); err == nil {
+			if err := rows.Scan(&l.Numero, &l.Ocupado, &l.Reservado); err == nil {
 				lug = append(lug, l)
+				if !l.Ocupado && !l.Reservado {
+					libres++
+				}
 			}
 		}
-		c.JSON(http.StatusOK, gin.H{"lugares": lug})
-	})
 
-	// Lista pública de estacionamientos (mapa)
-	r.GET("/estacionamientos", func(c *gin.Context) {
-		type Item struct {
-			ID       int64   `json:"id"`
-			Nombre   string  `json:"nombre"`
-			Latitud  float64 `json:"latitud"`
-			Longitud float64 `json:"longitud"`
-			Total    int     `json:"total"`
-			Ocupados int     `json:"ocupados"`
-			Libres   int     `json:"libres"`
-		}
-		rows, err := db.Query(`
-			SELECT e.id, e.nombre, e.latitud, e.longitud,
-			       e.cantidad, COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END),0)
-			FROM estacionamientos e
-			LEFT JOIN lugares l ON l.estacionamiento_id = e.id
-			GROUP BY e.id`)
-		if err != nil {
+		var sinLugar int
+		if err := db.QueryRow(`
+			SELECT COUNT(1) FROM reservas
+			WHERE estacionamiento_id = ? AND status = 1 AND numero IS NULL AND desde <= ? AND hasta > ?`,
+			id, ahora, ahora).Scan(&sinLugar); err != nil {
 			dbErr(c, err)
 			return
 		}
-		defer rows.Close()
-
-		var list []Item
-		for rows.Next() {
-			var it Item
-			if err := rows.Scan(&it.ID, &it.Nombre, &it.Latitud, &it.Longitud, &it.Total, &it.Ocupados); err == nil {
-				it.Libres = it.Total - it.Ocupados
-				list = append(list, it)
-			}
-		}
-		c.JSON(http.StatusOK, gin.H{"estacionamientos": list})
+		c.JSON(http.StatusOK, gin.H{"lugares": lug, "reservas_sin_lugar": sinLugar, "libres": max(0, libres-sinLugar)})
 	})
 
 	// ✅ Puerto dinámico
@@ -534,7 +580,7 @@ func main() {
 		idStr := c.Param("id")
 		id, err := strconv.Atoi(idStr)
 		if err != nil || id <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "id inválido"})
+			fallar(c, errores.IDInvalido)
 			return
 		}
 
@@ -555,51 +601,78 @@ func main() {
 		SELECT id, nombre, latitud, longitud, cantidad,
 		       precio_por_hora, techado, seguridad, IFNULL(banos,0) AS banos, altura_max_m
 		FROM estacionamientos
-		WHERE id = ?`,
+		WHERE id = ? AND eliminado_at IS NULL`,
 			id,
 		).Scan(&eID, &nombre, &lat, &lng, &cantidad, &precio, &techado, &seguridad, &banosInt, &altura)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Estacionamiento no encontrado"})
+				fallar(c, errores.EstacionamientoNoEncontrado)
 				return
 			}
 			dbErr(c, err)
 			return
 		}
 
-		// 2) Resumen (total desde e.cantidad + ocupados reales en lugares)
-		var total, ocupados int
+		// 2) Resumen (total y ocupados desde las filas reales de lugares; las
+		// reservas que cubren ahora no cuentan como libres)
+		var total, ocupados, reservados int
+		ahora := time.Now()
 		if err := db.QueryRow(`
-		SELECT e.cantidad AS total,
-		       COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END), 0) AS ocupados
+		SELECT COUNT(l.numero) AS total,
+		       COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END), 0) AS ocupados,
+		       `+reservadosSQL+` AS reservados
 		FROM estacionamientos e
 		LEFT JOIN lugares l ON l.estacionamiento_id = e.id
-		WHERE e.id = ?
+		WHERE e.id = ? AND e.eliminado_at IS NULL
 		GROUP BY e.id
-	`, id).Scan(&total, &ocupados); err != nil {
+	`, ahora, ahora, id).Scan(&total, &ocupados, &reservados); err != nil {
 			dbErr(c, err)
 			return
 		}
-		libres := total - ocupados
+		libres := max(0, total-ocupados-reservados)
 
-		// 3) Días (si existen)
+		// 3) Días (si existen), en orden de la semana, y estado actual
 		rowsDias, err := db.Query(`
 		SELECT dia, desde, hasta
 		FROM dias_atencion
 		WHERE estacionamiento_id = ?
-		ORDER BY dia, desde`,
+		ORDER BY desde`,
 			id,
 		)
-		dias := make([]gin.H, 0, 7)
+		dias := make([]DiaAtencion, 0, 7)
 		if err == nil {
 			defer rowsDias.Close()
 			for rowsDias.Next() {
-				var dia, desde, hasta string
-				if err := rowsDias.Scan(&dia, &desde, &hasta); err == nil {
-					dias = append(dias, gin.H{"dia": dia, "desde": desde, "hasta": hasta})
+				var d DiaAtencion
+				if err := rowsDias.Scan(&d.Dia, &d.Desde, &d.Hasta); err == nil {
+					dias = append(dias, d)
 				}
 			}
 		}
+		sort.SliceStable(dias, func(i, j int) bool { return ordenDia(dias[i].Dia) < ordenDia(dias[j].Dia) })
+
+		// 4) Estado con excepciones (feriados) y las de los próximos 30 días
+		desde, hasta := ventanaEstado(ahora)
+		horarios, err := cargarHorarios([]int64{int64(id)}, desde, hasta)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		estado := horarios[int64(id)].estado(ahora)
+		excepciones, err := listarExcepciones(id, inicioDia(ahora), inicioDia(ahora).AddDate(0, 0, 30))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+
+		// 5) Tarifa vigente (nil si no hay ni precio_por_hora)
+		var tarifa *versionTarifa
+		if vt, ok, err := tarifaVigente(id, ahora); err != nil {
+			dbErr(c, err)
+			return
+		} else if ok {
+			tarifa = &vt
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"id":       eID,
@@ -632,9 +705,14 @@ func main() {
 				return nil
 			}(),
 			"resumen": gin.H{
-				"total": total, "ocupados": ocupados, "libres": libres,
+				"total": total, "ocupados": ocupados, "reservados": reservados, "libres": libres,
 			},
-			"dias": dias,
+			"dias":          dias,
+			"excepciones":   excepciones,
+			"tarifa":        tarifa,
+			"abierto_ahora": estado.AbiertoAhora,
+			"abre_a":        estado.AbreA,
+			"cierra_a":      estado.CierraA,
 		})
 	})
 
@@ -644,121 +722,31 @@ func main() {
 		idStr := c.Param("id")
 		id, err := strconv.Atoi(idStr)
 		if err != nil || id <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "id inválido"})
+			fallar(c, errores.IDInvalido)
 			return
 		}
 
-		var total, ocupados int
+		var total, ocupados, reservados int
+		ahora := time.Now()
 		if err := db.QueryRow(`
-		SELECT e.cantidad AS total,
-		       COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END), 0) AS ocupados
+		SELECT COUNT(l.numero) AS total,
+		       COALESCE(SUM(CASE WHEN l.ocupado=1 THEN 1 ELSE 0 END), 0) AS ocupados,
+		       `+reservadosSQL+` AS reservados
 		FROM estacionamientos e
 		LEFT JOIN lugares l ON l.estacionamiento_id = e.id
-		WHERE e.id = ?
+		WHERE e.id = ? AND e.eliminado_at IS NULL
 		GROUP BY e.id
-	`, id).Scan(&total, &ocupados); err != nil {
+	`, ahora, ahora, id).Scan(&total, &ocupados, &reservados); err != nil {
 			if err == sql.ErrNoRows {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Estacionamiento no encontrado"})
+				fallar(c, errores.EstacionamientoNoEncontrado)
 				return
 			}
 			dbErr(c, err)
 			return
 		}
 
-		libres := total - ocupados
-		c.JSON(http.StatusOK, gin.H{"total": total, "ocupados": ocupados, "libres": libres})
-	})
-
-	// ======== RESERVAS (VIP) ========
-
-	// POST /reservas { "estacionamiento_id": number }
-	r.POST("/reservas", AuthMiddleware(), func(c *gin.Context) {
-		var body struct {
-			EstacionamientoID int `json:"estacionamiento_id"`
-		}
-		if err := c.BindJSON(&body); err != nil || body.EstacionamientoID <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
-			return
-		}
-
-		uidVal, _ := c.Get("userID")
-		userID := uidVal.(int)
-
-		// Solo VIP
-		isVip, err := userIsVIP(userID)
-		if err != nil || !isVip {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Solo usuarios VIP pueden reservar"})
-			return
-		}
-
-		// ¿ya tiene activa?
-		exists, err := hasActiveReservation(userID, body.EstacionamientoID)
-		if err != nil {
-			dbErr(c, err)
-			return
-		}
-		if exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "Ya tenés una reserva activa en este estacionamiento"})
-			return
-		}
-
-		_, err = db.Exec(`
-		INSERT INTO reservas (user_id, estacionamiento_id, status)
-		VALUES (?,?,1)
-	`, userID, body.EstacionamientoID)
-		if err != nil {
-			dbErr(c, err)
-			return
-		}
-		c.JSON(http.StatusCreated, gin.H{"ok": true})
-	})
-
-	// DELETE /reservas { "estacionamiento_id": number }
-	r.DELETE("/reservas", AuthMiddleware(), func(c *gin.Context) {
-		var body struct {
-			EstacionamientoID int `json:"estacionamiento_id"`
-		}
-		if err := c.BindJSON(&body); err != nil || body.EstacionamientoID <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Formato inválido"})
-			return
-		}
-
-		uidVal, _ := c.Get("userID")
-		userID := uidVal.(int)
-
-		res, err := db.Exec(`
-		UPDATE reservas
-		SET status=0, canceled_at=NOW()
-		WHERE user_id=? AND estacionamiento_id=? AND status=1
-	`, userID, body.EstacionamientoID)
-		if err != nil {
-			dbErr(c, err)
-			return
-		}
-		aff, _ := res.RowsAffected()
-		if aff == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "No tenés una reserva activa para cancelar"})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"ok": true})
-	})
-
-	// GET /reservas/estado?estacionamiento_id=123
-	r.GET("/reservas/estado", AuthMiddleware(), func(c *gin.Context) {
-		estID, _ := strconv.Atoi(c.Query("estacionamiento_id"))
-		if estID <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "id inválido"})
-			return
-		}
-		uidVal, _ := c.Get("userID")
-		userID := uidVal.(int)
-
-		ok, err := hasActiveReservation(userID, estID)
-		if err != nil {
-			dbErr(c, err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"activa": ok})
+		libres := max(0, total-ocupados-reservados)
+		c.JSON(http.StatusOK, gin.H{"total": total, "ocupados": ocupados, "reservados": reservados, "libres": libres})
 	})
 
 	// ✅ Puerto dinámico y arranque
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- PERFIL / CUENTA (/me) -------------
+
+const tokenCambioEmail = "email"
+
+var idiomasSoportados = []string{"es", "en", "pt"}
+
+var rePatente = regexp.MustCompile(`^[A-Z0-9]{5,10}$`)
+
+func normalizarPatente(p string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", ".", "").Replace(p))
+}
+
+func patentesUsuario(userID int) ([]string, error) {
+	rows, err := db.Query(`SELECT patente FROM vehiculos WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func perfilUsuario(userID int) (gin.H, error) {
+	var (
+		email               string
+		vip, verificado     int
+		nombre, tel, idioma sql.NullString
+	)
+	err := db.QueryRow(`
+		SELECT email, vip, email_verificado, nombre, telefono, idioma
+		FROM usuarios WHERE id = ? AND eliminado_at IS NULL`, userID,
+	).Scan(&email, &vip, &verificado, &nombre, &tel, &idioma)
+	if err != nil {
+		return nil, err
+	}
+	patentes, err := patentesUsuario(userID)
+	if err != nil {
+		return nil, err
+	}
+	dosFA, err := tiene2FAActivo(userID)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := rolesUsuario(userID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"id":               userID,
+		"email":            email,
+		"email_verificado": verificado == 1,
+		"vip":              vip == 1,
+		"nombre":           nullStringPtr(nombre),
+		"telefono":         nullStringPtr(tel),
+		"idioma":           idioma.String,
+		"patentes":         patentes,
+		"roles":            roles,
+		"2fa":              dosFA,
+	}, nil
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if s.Valid {
+		return &s.String
+	}
+	return nil
+}
+
+// errCuentaConReservas: el dueño tiene reservas activas de terceros en sus estacionamientos.
+var errCuentaConReservas = errors.New("estacionamientos con reservas activas")
+
+// eliminarCuenta anonimiza al usuario (las reservas quedan como historial),
+// cancela sus reservas que no están en curso, da de baja sus
+// estacionamientos y cierra todas sus sesiones.
+func eliminarCuenta(userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow(`
+		SELECT COUNT(1)
+		FROM reservas r
+		JOIN estacionamientos e ON e.id = r.estacionamiento_id
+		WHERE e.duenio_id = ? AND r.user_id <> ? AND r.status = 1`, userID, userID,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return errCuentaConReservas
+	}
+
+	now := time.Now()
+	// las que están en curso siguen hasta que el auto sale
+	motivo := "cuenta eliminada"
+	if _, err := transicionarReservas(tx, `r.user_id = ? AND r.status = 1`, []interface{}{userID},
+		reservaCanceladaUsuario, &userID, &motivo, now); err != nil {
+		return err
+	}
+	stmts := []struct {
+		q    string
+		args []interface{}
+	}{
+		{`DELETE FROM estacionamiento_staff WHERE estacionamiento_id IN (SELECT id FROM estacionamientos WHERE duenio_id=?)`, []interface{}{userID}},
+		{`UPDATE api_keys SET revoked_at=? WHERE revoked_at IS NULL AND estacionamiento_id IN (SELECT id FROM estacionamientos WHERE duenio_id=?)`, []interface{}{now, userID}},
+		{`UPDATE estacionamientos SET eliminado_at=? WHERE duenio_id=? AND eliminado_at IS NULL`, []interface{}{now, userID}},
+		{`DELETE FROM estacionamiento_staff WHERE user_id=?`, []interface{}{userID}},
+		{`DELETE FROM usuario_roles WHERE user_id=?`, []interface{}{userID}},
+		{`DELETE FROM usuario_2fa WHERE user_id=?`, []interface{}{userID}},
+		{`DELETE FROM codigos_recuperacion WHERE user_id=?`, []interface{}{userID}},
+		{`DELETE FROM vehiculos WHERE user_id=?`, []interface{}{userID}},
+		{`UPDATE tokens_usuario SET used_at=? WHERE user_id=? AND used_at IS NULL`, []interface{}{now, userID}},
+		{`UPDATE sesiones SET revoked_at=? WHERE user_id=? AND revoked_at IS NULL`, []interface{}{now, userID}},
+		{`UPDATE usuarios
+		  SET email=?, password_hash='', nombre=NULL, telefono=NULL, vip=0, eliminado_at=?
+		  WHERE id=?`, []interface{}{fmt.Sprintf("eliminado-%d@invalid", userID), now, userID}},
+	}
+	for _, st := range stmts {
+		if _, err := tx.Exec(st.q, st.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func verificarPassword(userID int, password string) (bool, error) {
+	u, err := buscarUsuario(userID)
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil, nil
+}
+
+func registrarRutasPerfil(r *gin.Engine) {
+	// GET /me
+	r.GET("/me", AuthMiddleware(), func(c *gin.Context) {
+		perfil, err := perfilUsuario(c.GetInt("userID"))
+		if err == sql.ErrNoRows {
+			fallar(c, errores.UsuarioNoEncontrado)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, perfil)
+	})
+
+	// PATCH /me { "nombre"?, "telefono"?, "patentes"?, "idioma"? }
+	r.PATCH("/me", AuthMiddleware(), func(c *gin.Context) {
+		var in struct {
+			Nombre   *string   `json:"nombre" binding:"omitempty,max=100"`
+			Telefono *string   `json:"telefono" binding:"omitempty,max=32,telefono"`
+			Patentes *[]string `json:"patentes"`
+			Idioma   *string   `json:"idioma"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		userID := c.GetInt("userID")
+
+		sets := []string{}
+		args := []interface{}{}
+		if in.Nombre != nil {
+			sets = append(sets, "nombre = ?")
+			args = append(args, strings.TrimSpace(*in.Nombre))
+		}
+		if in.Telefono != nil {
+			sets = append(sets, "telefono = ?")
+			args = append(args, strings.TrimSpace(*in.Telefono))
+		}
+		if in.Idioma != nil {
+			if !contiene(idiomasSoportados, *in.Idioma) {
+				errores.Responder(c, errores.Nuevo(errores.IdiomaNoSoportado).Con("permitidos", idiomasSoportados))
+				return
+			}
+			sets = append(sets, "idioma = ?")
+			args = append(args, *in.Idioma)
+		}
+		var patentes []string
+		if in.Patentes != nil {
+			for _, p := range *in.Patentes {
+				p = normalizarPatente(p)
+				if !rePatente.MatchString(p) {
+					errores.Responder(c, errores.Nuevo(errores.PatenteInvalida).Con("patente", p))
+					return
+				}
+				if !contiene(patentes, p) {
+					patentes = append(patentes, p)
+				}
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+		if len(sets) > 0 {
+			if _, err := tx.Exec(`UPDATE usuarios SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, userID)...); err != nil {
+				dbErr(c, err)
+				return
+			}
+		}
+		if in.Patentes != nil {
+			// se reemplaza el conjunto: se borran las que no vienen y se agregan
+			// las nuevas; los vehículos que siguen conservan sus datos. Los que
+			// tienen reservas sin terminar no se pueden quitar (como en
+			// DELETE /vehiculos/:id)
+			filtro := `TRUE`
+			var fArgs []interface{}
+			if len(patentes) > 0 {
+				filtro = `v.patente NOT IN (?` + strings.Repeat(", ?", len(patentes)-1) + `)`
+				for _, p := range patentes {
+					fArgs = append(fArgs, p)
+				}
+			}
+			conReservas, err := patentesConReservas(tx, userID, filtro, fArgs...)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if len(conReservas) > 0 {
+				errores.Responder(c, errores.Nuevo(errores.VehiculoConReservas).Con("patentes", conReservas))
+				return
+			}
+			if _, err := tx.Exec(`DELETE v FROM vehiculos v WHERE v.user_id = ? AND `+filtro,
+				append([]interface{}{userID}, fArgs...)...); err != nil {
+				dbErr(c, err)
+				return
+			}
+			for _, p := range patentes {
+				if _, err := tx.Exec(`INSERT IGNORE INTO vehiculos (user_id, patente) VALUES (?, ?)`, userID, p); err != nil {
+					dbErr(c, err)
+					return
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+
+		perfil, err := perfilUsuario(userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, perfil)
+	})
+
+	// POST /me/password { "actual": "...", "nueva": "..." }
+	// Cierra las demás sesiones; la actual sigue activa.
+	r.POST("/me/password", AuthMiddleware(), func(c *gin.Context) {
+		var in struct {
+			Actual string `json:"actual" binding:"required"`
+			Nueva  string `json:"nueva" binding:"required,password"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		userID := c.GetInt("userID")
+		ok, err := verificarPassword(userID, in.Actual)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.PasswordIncorrecta)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(in.Nueva), bcrypt.DefaultCost)
+		if err != nil {
+			fallar(c, errores.Interno)
+			return
+		}
+		if _, err := db.Exec(`UPDATE usuarios SET password_hash = ? WHERE id = ?`, string(hash), userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := db.Exec(`
+			UPDATE sesiones SET revoked_at = ?
+			WHERE user_id = ? AND id <> ? AND revoked_at IS NULL`,
+			time.Now(), userID, c.GetString("sessionID")); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /me/email { "email": "nuevo@...", "password": "..." }
+	// El cambio se aplica recién cuando se confirma desde el mail nuevo.
+	r.POST("/me/email", AuthMiddleware(), func(c *gin.Context) {
+		var in struct {
+			Email    string `json:"email" binding:"required,email,max=255"`
+			Password string `json:"password" binding:"required"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		nuevo := normalizarEmail(in.Email)
+		userID := c.GetInt("userID")
+		ok, err := verificarPassword(userID, in.Password)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.PasswordIncorrecta)
+			return
+		}
+		token, err := crearTokenUsuario(userID, tokenCambioEmail, nuevo, 24*time.Hour)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		link := appURL() + "/me/email/confirmar?token=" + url.QueryEscape(token)
+		enviarMail(nuevo, "Confirmá tu nuevo email",
+			"Para usar este email en tu cuenta entrá a:\n\n"+link+"\n\nEl link vence en 24 horas.")
+		c.JSON(http.StatusAccepted, gin.H{"mensaje": "Te enviamos un mail al nuevo email para confirmarlo"})
+	})
+
+	// GET /me/email/confirmar?token=...
+	r.GET("/me/email/confirmar", func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			fallar(c, errores.EnlaceInvalido)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+
+		userID, nuevo, err := consumirTokenUsuario(tx, token, tokenCambioEmail)
+		if err != nil {
+			if errors.Is(err, errTokenInvalido) {
+				fallar(c, errores.EnlaceInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		var anterior string
+		if err := tx.QueryRow(`SELECT email FROM usuarios WHERE id = ? AND eliminado_at IS NULL`, userID).Scan(&anterior); err != nil {
+			fallar(c, errores.EnlaceInvalido)
+			return
+		}
+		_, err = tx.Exec(`UPDATE usuarios SET email = ?, email_verificado = 1 WHERE id = ?`, nuevo, userID)
+		if esDuplicado(err) {
+			fallar(c, errores.EmailEnUso)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := aceptarInvitacionesStaff(tx, userID, nuevo, 0); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		enviarMail(anterior, "Cambiaste tu email",
+			"El email de tu cuenta ahora es "+nuevo+". Si no fuiste vos, contactanos.")
+		c.JSON(http.StatusOK, gin.H{"ok": true, "email": nuevo})
+	})
+
+	// DELETE /me { "password": "..." }
+	r.DELETE("/me", AuthMiddleware(), func(c *gin.Context) {
+		var in struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&in); err != nil || in.Password == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		userID := c.GetInt("userID")
+		ok, err := verificarPassword(userID, in.Password)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.PasswordIncorrecta)
+			return
+		}
+		if err := eliminarCuenta(userID); err != nil {
+			if errors.Is(err, errCuentaConReservas) {
+				fallar(c, errores.CuentaConReservas)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
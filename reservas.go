@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- RESERVAS -------------
+// Una reserva es una franja [desde, hasta) en un estacionamiento, con lugar
+// asignado (numero) o no. Tiene que caer dentro del horario de atención
+// (excepciones incluidas) y en ningún momento de la franja puede haber más
+// reservas que lugares. Mientras dura, cuenta como no disponible en
+// /estado/:id, el resumen y la lista. Las reservas viejas sin franja
+// (desde/hasta NULL) quedan como historial y no ocupan cupo.
+
+const (
+	reservaDuracionDefault    = time.Hour
+	reservaDuracionMaxima     = 24 * time.Hour
+	reservaAnticipacionMaxima = 30 * 24 * time.Hour
+	// margen para relojes desfasados al reservar "desde ahora"
+	reservaToleranciaPasado = 5 * time.Minute
+)
+
+var (
+	errReservaSuperpuesta  = errors.New("el usuario ya tiene una reserva en esa franja")
+	errFueraDeHorario      = errors.New("la franja cae fuera del horario de atención")
+	errSinDisponibilidad   = errors.New("no hay lugares disponibles en esa franja")
+	errLugarInexistente    = errors.New("lugar inexistente")
+	errLugarNoDisponible   = errors.New("el lugar está ocupado o reservado en esa franja")
+	errEstacionamientoBaja = errors.New("estacionamiento inexistente o dado de baja")
+)
+
+// consultor es lo que tienen en común *sql.DB y *sql.Tx.
+type consultor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// reservadosSQL cuenta para el estacionamiento e las reservas activas que
+// cubren el instante ? (se pasa dos veces) y cuyo lugar no está ya ocupado
+// (si el conductor llegó, el lugar ya cuenta como ocupado).
+const reservadosSQL = `(SELECT COUNT(1) FROM reservas r
+	WHERE r.estacionamiento_id = e.id AND r.status = 1 AND r.desde <= ? AND r.hasta > ?
+	  AND NOT EXISTS (SELECT 1 FROM lugares lo
+	                  WHERE lo.estacionamiento_id = r.estacionamiento_id AND lo.numero = r.numero AND lo.ocupado = 1))`
+
+func userIsVIP(userID int) (bool, error) {
+	var vip int
+	err := db.QueryRow(`SELECT vip FROM usuarios WHERE id=?`, userID).Scan(&vip)
+	return vip == 1, err
+}
+
+// hasActiveReservation indica si el usuario tiene una reserva activa que
+// todavía no terminó en el estacionamiento. Las viejas sin franja no cuentan
+// (asegurarEsquema las cierra).
+func hasActiveReservation(userID, estID int) (bool, error) {
+	var cnt int
+	err := db.QueryRow(`
+		SELECT COUNT(1)
+		FROM reservas
+		WHERE user_id=? AND estacionamiento_id=? AND status=1 AND hasta > ?
+	`, userID, estID, time.Now()).Scan(&cnt)
+	return cnt > 0, err
+}
+
+// picoReservas devuelve la mayor cantidad de reservas activas simultáneas
+// dentro de [desde, hasta).
+func picoReservas(q consultor, estID int, desde, hasta time.Time) (int, error) {
+	rows, err := q.Query(`
+		SELECT desde, hasta FROM reservas
+		WHERE estacionamiento_id = ? AND status = 1 AND desde < ? AND hasta > ?`,
+		estID, hasta, desde)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	type evento struct {
+		t     time.Time
+		delta int
+	}
+	var evs []evento
+	for rows.Next() {
+		var d, h time.Time
+		if err := rows.Scan(&d, &h); err != nil {
+			return 0, err
+		}
+		evs = append(evs, evento{d, 1}, evento{h, -1})
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// a igual instante primero las salidas: [a, b) y [b, c) no se pisan
+	sort.Slice(evs, func(i, j int) bool {
+		if evs[i].t.Equal(evs[j].t) {
+			return evs[i].delta < evs[j].delta
+		}
+		return evs[i].t.Before(evs[j].t)
+	})
+	pico, n := 0, 0
+	for _, ev := range evs {
+		if n += ev.delta; n > pico {
+			pico = n
+		}
+	}
+	return pico, nil
+}
+
+type reservaNueva struct {
+	EstacionamientoID int        `json:"estacionamiento_id" binding:"required,min=1"`
+	VehiculoID        int        `json:"vehiculo_id" binding:"omitempty,min=1"`
+	Numero            *int       `json:"numero" binding:"omitempty,min=1"`
+	Desde             *time.Time `json:"desde"`
+	Hasta             *time.Time `json:"hasta"`
+}
+
+// normalizar completa la franja (desde ahora, una hora) y la valida.
+func (in *reservaNueva) normalizar(ahora time.Time) []errorValidacion {
+	if in.Desde == nil {
+		in.Desde = &ahora
+	}
+	if in.Hasta == nil {
+		h := in.Desde.Add(reservaDuracionDefault)
+		in.Hasta = &h
+	}
+	var errs []errorValidacion
+	switch {
+	case in.Desde.Before(ahora.Add(-reservaToleranciaPasado)):
+		errs = append(errs, errorValidacion{Campo: "desde", Motivo: "no puede estar en el pasado"})
+	case in.Desde.After(ahora.Add(reservaAnticipacionMaxima)):
+		errs = append(errs, errorValidacion{Campo: "desde", Motivo: "se puede reservar hasta 30 días antes"})
+	}
+	switch {
+	case !in.Hasta.After(*in.Desde):
+		errs = append(errs, errorValidacion{Campo: "hasta", Motivo: "debe ser posterior a desde"})
+	case in.Hasta.Sub(*in.Desde) > reservaDuracionMaxima:
+		errs = append(errs, errorValidacion{Campo: "hasta", Motivo: "la reserva dura como máximo 24 horas"})
+	}
+	return errs
+}
+
+// validarDisponibilidad controla horario, superposición con otras reservas
+// del usuario, el lugar pedido y el cupo en toda la franja.
+func validarDisponibilidad(q consultor, userID int, in reservaNueva, ahora time.Time) error {
+	estID, desde, hasta := in.EstacionamientoID, *in.Desde, *in.Hasta
+
+	horarios, err := cargarHorarios([]int64{int64(estID)}, desde.AddDate(0, 0, -1), hasta.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	if !horarios[int64(estID)].abiertoEntre(desde, hasta) {
+		return errFueraDeHorario
+	}
+
+	var propias int
+	if err := q.QueryRow(`
+		SELECT COUNT(1) FROM reservas
+		WHERE user_id = ? AND estacionamiento_id = ? AND status = 1 AND desde < ? AND hasta > ?`,
+		userID, estID, hasta, desde).Scan(&propias); err != nil {
+		return err
+	}
+	if propias > 0 {
+		return errReservaSuperpuesta
+	}
+
+	// la franja empieza ya: también cuentan los ocupados sin reserva
+	empiezaYa := !desde.After(ahora)
+
+	if in.Numero != nil {
+		var ocupado bool
+		err := q.QueryRow(`SELECT ocupado FROM lugares WHERE estacionamiento_id = ? AND numero = ?`, estID, *in.Numero).Scan(&ocupado)
+		if err == sql.ErrNoRows {
+			return errLugarInexistente
+		}
+		if err != nil {
+			return err
+		}
+		var otras int
+		if err := q.QueryRow(`
+			SELECT COUNT(1) FROM reservas
+			WHERE estacionamiento_id = ? AND numero = ? AND status = 1 AND desde < ? AND hasta > ?`,
+			estID, *in.Numero, hasta, desde).Scan(&otras); err != nil {
+			return err
+		}
+		if otras > 0 || (empiezaYa && ocupado) {
+			return errLugarNoDisponible
+		}
+	}
+
+	var total int
+	if err := q.QueryRow(`SELECT COUNT(1) FROM lugares WHERE estacionamiento_id = ?`, estID).Scan(&total); err != nil {
+		return err
+	}
+	pico, err := picoReservas(q, estID, desde, hasta)
+	if err != nil {
+		return err
+	}
+	if pico+1 > total {
+		return errSinDisponibilidad
+	}
+	if empiezaYa {
+		var ocupadosSinReserva, reservadosAhora int
+		if err := q.QueryRow(`
+			SELECT COUNT(1) FROM lugares l
+			WHERE l.estacionamiento_id = ? AND l.ocupado = 1
+			  AND NOT EXISTS (SELECT 1 FROM reservas r
+			                  WHERE r.estacionamiento_id = l.estacionamiento_id AND r.numero = l.numero
+			                    AND r.status = 1 AND r.desde <= ? AND r.hasta > ?)`,
+			estID, ahora, ahora).Scan(&ocupadosSinReserva); err != nil {
+			return err
+		}
+		if err := q.QueryRow(`
+			SELECT COUNT(1) FROM reservas
+			WHERE estacionamiento_id = ? AND status = 1 AND desde <= ? AND hasta > ?`,
+			estID, ahora, ahora).Scan(&reservadosAhora); err != nil {
+			return err
+		}
+		if ocupadosSinReserva+reservadosAhora+1 > total {
+			return errSinDisponibilidad
+		}
+	}
+	return nil
+}
+
+// crearReserva valida e inserta en una transacción. El FOR UPDATE sobre el
+// estacionamiento serializa las altas concurrentes (y los cambios de
+// capacidad, que toman el mismo lock), así dos pedidos no pueden contar el
+// mismo cupo libre. El índice único sobre la franja activa frena además el
+// doble envío del mismo pedido. Nace confirmed (ver estados_reserva.go).
+func crearReserva(userID int, in reservaNueva, vehiculoID *int, ahora time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var estID int
+	err = tx.QueryRow(`SELECT id FROM estacionamientos WHERE id = ? AND eliminado_at IS NULL FOR UPDATE`,
+		in.EstacionamientoID).Scan(&estID)
+	if err == sql.ErrNoRows {
+		return 0, errEstacionamientoBaja
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := validarDisponibilidad(tx, userID, in, ahora); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO reservas (user_id, estacionamiento_id, status, estado, vehiculo_id, numero, desde, hasta, confirmada_at, created_at)
+		VALUES (?,?,1,?,?,?,?,?,?,?)`,
+		userID, in.EstacionamientoID, reservaConfirmada, vehiculoID, in.Numero, *in.Desde, *in.Hasta, ahora, ahora)
+	if esDuplicado(err) {
+		return 0, errReservaSuperpuesta
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := registrarHistorial(tx, id, nil, reservaConfirmada, &userID, nil, ahora); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// errorReservaJSON responde los errores de validarDisponibilidad; devuelve
+// false si err no es uno de ellos.
+func errorReservaJSON(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, errEstacionamientoBaja):
+		fallar(c, errores.EstacionamientoNoEncontrado)
+	case errors.Is(err, errReservaSuperpuesta):
+		fallar(c, errores.ReservaActivaExistente)
+	case errors.Is(err, errFueraDeHorario):
+		fallar(c, errores.EstacionamientoCerrado)
+	case errors.Is(err, errSinDisponibilidad):
+		fallar(c, errores.SinDisponibilidad)
+	case errors.Is(err, errLugarInexistente):
+		fallar(c, errores.LugarNoEncontrado)
+	case errors.Is(err, errLugarNoDisponible):
+		fallar(c, errores.LugarNoDisponible)
+	default:
+		return false
+	}
+	return true
+}
+
+type Reserva struct {
+	ID                int        `json:"id"`
+	EstacionamientoID int        `json:"estacionamiento_id"`
+	Estacionamiento   string     `json:"estacionamiento"`
+	VehiculoID        *int       `json:"vehiculo_id"`
+	Numero            *int       `json:"numero"`
+	Desde             *time.Time `json:"desde"`
+	Hasta             *time.Time `json:"hasta"`
+	Estado            string     `json:"estado"`
+	Activa            bool       `json:"activa"`
+	ConfirmadaEn      *time.Time `json:"confirmada_at"`
+	CanceladaEn       *time.Time `json:"canceled_at"`
+	LlegadaEn         *time.Time `json:"llegada_at"`
+	FinalizadaEn      *time.Time `json:"finalizada_at"`
+	MotivoFin         *string    `json:"motivo_fin"`
+	CreadaEn          *time.Time `json:"created_at"`
+}
+
+const columnasReserva = `r.id, r.estacionamiento_id, IFNULL(e.nombre, ''), r.vehiculo_id, r.numero,
+	r.desde, r.hasta, r.estado, r.confirmada_at, r.canceled_at, r.llegada_at, r.finalizada_at, r.motivo_fin, r.created_at`
+
+// scanReserva lee columnasReserva y, en extra, las columnas que la consulta
+// agregue después.
+func scanReserva(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Reserva, error) {
+	var (
+		r                                                                Reserva
+		vehiculo, numero                                                 sql.NullInt64
+		desde, hasta, confirmada, cancelada, llegada, finalizada, creada sql.NullTime
+		motivo                                                           sql.NullString
+	)
+	dest := append([]interface{}{&r.ID, &r.EstacionamientoID, &r.Estacionamiento, &vehiculo, &numero,
+		&desde, &hasta, &r.Estado, &confirmada, &cancelada, &llegada, &finalizada, &motivo, &creada}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return r, err
+	}
+	if vehiculo.Valid {
+		v := int(vehiculo.Int64)
+		r.VehiculoID = &v
+	}
+	if numero.Valid {
+		n := int(numero.Int64)
+		r.Numero = &n
+	}
+	for _, t := range []struct {
+		src sql.NullTime
+		dst **time.Time
+	}{{desde, &r.Desde}, {hasta, &r.Hasta}, {confirmada, &r.ConfirmadaEn}, {cancelada, &r.CanceladaEn}, {llegada, &r.LlegadaEn},
+		{finalizada, &r.FinalizadaEn}, {creada, &r.CreadaEn}} {
+		if t.src.Valid {
+			v := t.src.Time
+			*t.dst = &v
+		}
+	}
+	r.MotivoFin = nullStringPtr(motivo)
+	r.Activa = estadoReserva(r.Estado).ocupaCupo()
+	return r, nil
+}
+
+func registrarRutasReservas(r *gin.Engine) {
+	// ======== RESERVAS (VIP) ========
+
+	// POST /reservas { "estacionamiento_id": number, "vehiculo_id"?: number,
+	//                  "desde"?: RFC3339 (ahora), "hasta"?: RFC3339 (desde + 1 h), "numero"?: number }
+	r.POST("/reservas", AuthMiddleware(), RequirePermission(permReservasCrear), func(c *gin.Context) {
+		var body reservaNueva
+		if !bindJSON(c, &body) {
+			return
+		}
+		ahora := time.Now()
+		if errs := body.normalizar(ahora); len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+
+		uidVal, _ := c.Get("userID")
+		userID := uidVal.(int)
+
+		// Solo VIP
+		isVip, err := userIsVIP(userID)
+		if err != nil || !isVip {
+			fallar(c, errores.SoloVIP)
+			return
+		}
+		// suspendido por no-shows (ver vencimientos.go)
+		if hasta, err := reservasSuspendidas(userID, ahora); err != nil || hasta != nil {
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			errores.Responder(c, errores.Nuevo(errores.ReservasSuspendidas).Con("hasta", hasta))
+			return
+		}
+
+		if ok, err := estacionamientoActivo(body.EstacionamientoID); err != nil || !ok {
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			fallar(c, errores.EstacionamientoNoEncontrado)
+			return
+		}
+
+		// vehículo: el indicado o, si tiene uno solo, ese
+		if body.VehiculoID == 0 {
+			if body.VehiculoID, err = vehiculoPorDefecto(userID); err != nil {
+				dbErr(c, err)
+				return
+			}
+		}
+		var vehiculoID *int
+		if body.VehiculoID > 0 {
+			numero := 0
+			if body.Numero != nil {
+				numero = *body.Numero
+			}
+			v, err := vehiculoDeUsuario(userID, body.VehiculoID)
+			if err == nil {
+				err = validarVehiculoEnEstacionamiento(v, body.EstacionamientoID, numero)
+			}
+			if err != nil {
+				if !errorVehiculoJSON(c, err) {
+					dbErr(c, err)
+				}
+				return
+			}
+			vehiculoID = &v.ID
+		}
+
+		id, err := crearReserva(userID, body, vehiculoID, ahora)
+		if err != nil {
+			if !errorReservaJSON(c, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		reserva, err := scanReserva(db.QueryRow(`
+			SELECT `+columnasReserva+` FROM reservas r
+			LEFT JOIN estacionamientos e ON e.id = r.estacionamiento_id
+			WHERE r.id = ?`, id))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, reserva)
+	})
+
+	// GET /reservas?estado=&desde=&hasta=&limite=&cursor= (ver reservas_listado.go)
+	// Las del usuario; las canceladas por el estacionamiento traen el motivo
+	// en motivo_fin.
+	r.GET("/reservas", AuthMiddleware(), func(c *gin.Context) {
+		f, errs := leerFiltroReservas(c)
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+		q, args := f.sql(`
+			SELECT `+columnasReserva+` FROM reservas r
+			LEFT JOIN estacionamientos e ON e.id = r.estacionamiento_id
+			WHERE r.user_id = ?`, c.GetInt("userID"))
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+		list := []Reserva{}
+		for rows.Next() {
+			res, err := scanReserva(rows)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			list = append(list, res)
+		}
+		if err := rows.Err(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		n, siguiente := f.siguiente(len(list), func(i int) Reserva { return list[i] })
+		c.JSON(http.StatusOK, gin.H{"reservas": list[:n], "siguiente": siguiente})
+	})
+
+	// DELETE /reservas { "estacionamiento_id": number }: cancela todas las activas ahí
+	r.DELETE("/reservas", AuthMiddleware(), func(c *gin.Context) {
+		var body struct {
+			EstacionamientoID int `json:"estacionamiento_id"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.EstacionamientoID <= 0 {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+
+		uidVal, _ := c.Get("userID")
+		userID := uidVal.(int)
+
+		// las que ya están en curso no se cancelan: terminan solas
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+		canceladas, err := transicionarReservas(tx, `r.user_id = ? AND r.estacionamiento_id = ? AND r.status = 1`,
+			[]interface{}{userID, body.EstacionamientoID}, reservaCanceladaUsuario, &userID, nil, time.Now())
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if len(canceladas) == 0 {
+			fallar(c, errores.ReservaNoEncontrada)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "canceladas": len(canceladas)})
+	})
+
+	// DELETE /reservas/:id: cancela una reserva puntual
+	r.DELETE("/reservas/:id", AuthMiddleware(), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		userID := c.GetInt("userID")
+		actual, err := transicionarReserva(id, `r.user_id = ?`, []interface{}{userID}, reservaCanceladaUsuario, &userID, nil, time.Now())
+		if err != nil {
+			if !errorTransicionJSON(c, actual, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// GET /reservas/estado?estacionamiento_id=123
+	r.GET("/reservas/estado", AuthMiddleware(), func(c *gin.Context) {
+		estID, _ := strconv.Atoi(c.Query("estacionamiento_id"))
+		if estID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		uidVal, _ := c.Get("userID")
+		userID := uidVal.(int)
+
+		ok, err := hasActiveReservation(userID, estID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"activa": ok})
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- LISTADO DE RESERVAS -------------
+// GET /reservas (las propias) y GET /estacionamientos/:id/reservas (dueño y
+// staff) comparten filtros y paginación:
+//   estado=confirmed,checked_in  (ver estados_reserva.go)
+//   desde=2026-10-01 hasta=2026-10-31  franjas que tocan esas fechas
+//   limite=50 cursor=<siguiente de la respuesta anterior>
+// Orden: las que empiezan más tarde primero; las viejas sin franja al final.
+
+type filtroReservas struct {
+	where  []string
+	args   []interface{}
+	limite int
+}
+
+// leerFiltroReservas arma el WHERE (sobre reservas r) con los filtros y el
+// cursor del query string.
+func leerFiltroReservas(c *gin.Context) (filtroReservas, []errorValidacion) {
+	f := filtroReservas{limite: limiteListaDefault}
+	var errs []errorValidacion
+
+	if v := c.Query("estado"); v != "" {
+		var marcas []string
+		var estados []interface{}
+		for _, e := range strings.Split(v, ",") {
+			e := estadoReserva(strings.TrimSpace(e))
+			if !e.valido() {
+				posibles := make([]string, len(estadosReserva))
+				for i, ev := range estadosReserva {
+					posibles[i] = string(ev)
+				}
+				errs = append(errs, errorValidacion{Campo: "estado", Motivo: "valores posibles: " + strings.Join(posibles, ", ")})
+				break
+			}
+			marcas = append(marcas, "?")
+			estados = append(estados, e)
+		}
+		f.where = append(f.where, "r.estado IN ("+strings.Join(marcas, ",")+")")
+		f.args = append(f.args, estados...)
+	}
+	for _, q := range []struct {
+		campo, cond string
+		dias        int
+	}{{"desde", "r.hasta > ?", 0}, {"hasta", "r.desde < ?", 1}} {
+		v, ok := c.GetQuery(q.campo)
+		if !ok {
+			continue
+		}
+		fecha, ok := parsearFecha(v)
+		if !ok {
+			errs = append(errs, errorValidacion{Campo: q.campo, Motivo: "fecha inválida, formato AAAA-MM-DD"})
+			continue
+		}
+		f.where = append(f.where, q.cond)
+		f.args = append(f.args, fecha.AddDate(0, 0, q.dias))
+	}
+
+	if v, ok := c.GetQuery("limite"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > limiteListaMaximo {
+			errs = append(errs, errorValidacion{Campo: "limite", Motivo: fmt.Sprintf("debe estar entre 1 y %d", limiteListaMaximo)})
+		}
+		f.limite = n
+	}
+	if v, ok := c.GetQuery("cursor"); ok {
+		cl, ok := decodificarCursor(v)
+		switch {
+		case !ok:
+			errs = append(errs, errorValidacion{Campo: "cursor", Motivo: "inválido"})
+		case cl.Valor == 0:
+			// ya en las que no tienen franja
+			f.where = append(f.where, "r.desde IS NULL AND r.id < ?")
+			f.args = append(f.args, cl.ID)
+		default:
+			d := time.Unix(int64(cl.Valor), 0)
+			f.where = append(f.where, "(r.desde < ? OR (r.desde = ? AND r.id < ?) OR r.desde IS NULL)")
+			f.args = append(f.args, d, d, cl.ID)
+		}
+	}
+	return f, errs
+}
+
+// sql completa la consulta: base termina en WHERE con sus condiciones.
+func (f filtroReservas) sql(base string, args ...interface{}) (string, []interface{}) {
+	q := base
+	for _, w := range f.where {
+		q += " AND " + w
+	}
+	q += fmt.Sprintf(" ORDER BY r.desde IS NULL, r.desde DESC, r.id DESC LIMIT %d", f.limite+1)
+	return q, append(args, f.args...)
+}
+
+// siguiente corta la página y devuelve el cursor si hay más.
+func (f filtroReservas) siguiente(n int, ultima func(int) Reserva) (int, *string) {
+	if n <= f.limite {
+		return n, nil
+	}
+	r := ultima(f.limite - 1)
+	cl := cursorLista{ID: int64(r.ID)}
+	if r.Desde != nil {
+		cl.Valor = float64(r.Desde.Unix())
+	}
+	s := cl.codificar()
+	return f.limite, &s
+}
+
+// ReservaEstacionamiento es una reserva vista desde el estacionamiento, con
+// quién la hizo.
+type ReservaEstacionamiento struct {
+	Reserva
+	UserID    int     `json:"user_id"`
+	Conductor *string `json:"conductor"`
+	Patente   *string `json:"patente"`
+}
+
+const columnasReservaEstacionamiento = columnasReserva + `, r.user_id, u.nombre, v.patente`
+
+const desdeReservaEstacionamiento = ` FROM reservas r
+	LEFT JOIN estacionamientos e ON e.id = r.estacionamiento_id
+	LEFT JOIN usuarios u ON u.id = r.user_id
+	LEFT JOIN vehiculos v ON v.id = r.vehiculo_id`
+
+func listarReservasEstacionamiento(q string, args ...interface{}) ([]ReservaEstacionamiento, error) {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []ReservaEstacionamiento{}
+	for rows.Next() {
+		var (
+			re              ReservaEstacionamiento
+			nombre, patente sql.NullString
+		)
+		if re.Reserva, err = scanReserva(rows, &re.UserID, &nombre, &patente); err != nil {
+			return nil, err
+		}
+		re.Conductor = nullStringPtr(nombre)
+		re.Patente = nullStringPtr(patente)
+		list = append(list, re)
+	}
+	return list, rows.Err()
+}
+
+func registrarRutasListadoReservas(r *gin.Engine) {
+	// GET /estacionamientos/:id/reservas?estado=&desde=&hasta=&limite=&cursor=
+	// Además de la página, llegadas_hoy: las confirmadas que todavía se
+	// esperan hoy (incluye las que están dentro de la gracia), por hora.
+	r.GET("/estacionamientos/:id/reservas", AuthMiddleware(), RequirePermissionEn(estIDParam("id"), permReservasVer), func(c *gin.Context) {
+		f, errs := leerFiltroReservas(c)
+		if len(errs) > 0 {
+			responderInvalidos(c, errs)
+			return
+		}
+		estID := c.GetInt("estacionamientoID")
+		q, args := f.sql(`SELECT `+columnasReservaEstacionamiento+desdeReservaEstacionamiento+`
+			WHERE r.estacionamiento_id = ?`, estID)
+		list, err := listarReservasEstacionamiento(q, args...)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		n, siguiente := f.siguiente(len(list), func(i int) Reserva { return list[i].Reserva })
+		list = list[:n]
+
+		ahora := time.Now()
+		llegadas, err := listarReservasEstacionamiento(`SELECT `+columnasReservaEstacionamiento+desdeReservaEstacionamiento+`
+			WHERE r.estacionamiento_id = ? AND r.estado = ? AND r.desde >= ? AND r.desde < ?
+			ORDER BY r.desde, r.id`,
+			estID, reservaConfirmada, ahora.Add(-reservasGracia()), inicioDia(ahora).AddDate(0, 0, 1))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reservas": list, "siguiente": siguiente, "llegadas_hoy": llegadas})
+	})
+
+	// DELETE /estacionamientos/:id/reservas/:reservaId { "motivo": "..." }
+	// Cancela una reserva del estacionamiento; el conductor ve el motivo en
+	// GET /reservas (motivo_fin) y en el historial.
+	r.DELETE("/estacionamientos/:id/reservas/:reservaId", AuthMiddleware(), RequirePermissionEn(estIDParam("id"), permReservasGestionar), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("reservaId"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var body struct {
+			Motivo string `json:"motivo" binding:"required,max=255"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		motivo := strings.TrimSpace(body.Motivo)
+		if motivo == "" {
+			responderInvalidos(c, []errorValidacion{{Campo: "motivo", Motivo: "obligatorio"}})
+			return
+		}
+		userID := c.GetInt("userID")
+		actual, err := transicionarReserva(id, `r.estacionamiento_id = ?`, []interface{}{c.GetInt("estacionamientoID")},
+			reservaCanceladaDuenio, &userID, &motivo, time.Now())
+		if err != nil {
+			if !errorTransicionJSON(c, actual, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /estacionamientos/:id/reservas/:reservaId/llegada
+	// Registra a mano que el conductor llegó (confirmed → checked_in): las
+	// reservas sin vehículo ni lugar no las detecta marcarLlegadas, y sirve
+	// también si la barrera o el sensor no la vieron. Lo hace quien opera la
+	// entrada (mismo permiso que POST /lugares/estado), desde RESERVAS_GRACIA
+	// antes del inicio hasta el fin de la franja.
+	r.POST("/estacionamientos/:id/reservas/:reservaId/llegada", AuthMiddleware(), RequirePermissionEn(estIDParam("id"), permLugaresEstado), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("reservaId"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		estID := c.GetInt("estacionamientoID")
+		var (
+			estado       estadoReserva
+			desde, hasta sql.NullTime
+		)
+		err = db.QueryRow(`SELECT estado, desde, hasta FROM reservas WHERE id = ? AND estacionamiento_id = ?`, id, estID).
+			Scan(&estado, &desde, &hasta)
+		if err == sql.ErrNoRows {
+			fallar(c, errores.ReservaNoEncontrada)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !estado.puedePasarA(reservaEnCurso) {
+			errores.Responder(c, errores.Nuevo(errores.TransicionReservaInvalida).Con("estado", estado))
+			return
+		}
+		ahora := time.Now()
+		if !desde.Valid || !hasta.Valid || desde.Time.After(ahora.Add(reservasGracia())) || !hasta.Time.After(ahora) {
+			fallar(c, errores.LlegadaFueraDeFranja)
+			return
+		}
+		userID := c.GetInt("userID")
+		actual, err := transicionarReserva(id, `r.estacionamiento_id = ?`, []interface{}{estID},
+			reservaEnCurso, &userID, nil, ahora)
+		if err != nil {
+			if !errorTransicionJSON(c, actual, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
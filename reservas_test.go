@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proyecto-parking-back/errores"
+)
+
+// conductorPrueba crea un conductor VIP con sesión y devuelve su access token.
+func conductorPrueba(t *testing.T, i int) string {
+	t.Helper()
+	res, err := db.Exec(`INSERT INTO usuarios (email, password_hash, vip) VALUES (?, 'x', 1)`,
+		fmt.Sprintf("conductor%d@prueba.test", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	if _, err := db.Exec(`INSERT INTO usuario_roles (user_id, rol) VALUES (?, 'driver')`, id); err != nil {
+		t.Fatal(err)
+	}
+	u, err := buscarUsuario(int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _, err := crearSesion(u.ID, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := emitirAccessToken(u, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Muchos conductores piden la misma franja a la vez: crearReserva tiene que
+// dejar entrar exactamente tantos como lugares y rechazar al resto.
+func TestCrearReservaConcurrente(t *testing.T) {
+	dbPrueba(t)
+	// por debajo del max_connections por defecto; el resto espera su conexión
+	db.SetMaxOpenConns(50)
+	t.Cleanup(func() { db.SetMaxOpenConns(0) })
+
+	r := motorPrueba()
+	registrarRutasReservas(r)
+
+	const lugares, pedidos = 5, 200
+	res, err := db.Exec(`INSERT INTO estacionamientos (duenio_id, nombre, cantidad, latitud, longitud) VALUES (1, 'e', ?, 0, 0)`, lugares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estID, _ := res.LastInsertId()
+	for n := 1; n <= lugares; n++ {
+		if _, err := db.Exec(`INSERT INTO lugares (estacionamiento_id, numero) VALUES (?, ?)`, estID, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := make([]string, pedidos)
+	for i := range tokens {
+		tokens[i] = conductorPrueba(t, i)
+	}
+
+	desde := time.Now().Add(2 * time.Hour).Truncate(time.Minute)
+	body := fmt.Sprintf(`{"estacionamiento_id": %d, "desde": %q, "hasta": %q}`,
+		estID, desde.Format(time.RFC3339), desde.Add(time.Hour).Format(time.RFC3339))
+
+	var (
+		wg      sync.WaitGroup
+		largada = make(chan struct{})
+		codigos = make([]int, pedidos)
+		cuerpos = make([]string, pedidos)
+	)
+	for i := 0; i < pedidos; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/reservas", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tokens[i])
+			w := httptest.NewRecorder()
+			<-largada
+			r.ServeHTTP(w, req)
+			codigos[i], cuerpos[i] = w.Code, w.Body.String()
+		}(i)
+	}
+	close(largada)
+	wg.Wait()
+
+	creadas := 0
+	for i, code := range codigos {
+		switch code {
+		case http.StatusCreated:
+			creadas++
+		case http.StatusConflict:
+			var e struct {
+				Codigo errores.Codigo `json:"codigo"`
+			}
+			if err := json.Unmarshal([]byte(cuerpos[i]), &e); err != nil || e.Codigo != errores.SinDisponibilidad {
+				t.Errorf("pedido %d: 409 %s, se esperaba %s", i, cuerpos[i], errores.SinDisponibilidad)
+			}
+		default:
+			t.Errorf("pedido %d: %d %s", i, code, cuerpos[i])
+		}
+	}
+	if creadas != lugares {
+		t.Errorf("%d respuestas 201, se esperaban %d", creadas, lugares)
+	}
+	var activas int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM reservas WHERE estacionamiento_id = ? AND status = 1`, estID).Scan(&activas); err != nil {
+		t.Fatal(err)
+	}
+	if activas != lugares {
+		t.Errorf("%d reservas con status = 1, se esperaban %d", activas, lugares)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- ROLES / PERMISOS -------------
+// Los roles viven en `usuario_roles`. estacionamiento_id = 0 es un rol global
+// (p.ej. admin); cualquier otro valor limita el rol a ese estacionamiento.
+// El dueño (duenio_id) tiene implícitamente el rol owner sobre sus
+// estacionamientos, el staff sale de `estacionamiento_staff` (ver staff.go)
+// y todo usuario es driver.
+
+const (
+	rolDriver = "driver"
+	rolOwner  = "owner"
+	rolStaff  = "staff"
+	rolAdmin  = "admin"
+)
+
+const (
+	permTodo                  = "*"
+	permReservasCrear         = "reservas.crear"
+	permReservasVer           = "reservas.ver"
+	permReservasGestionar     = "reservas.gestionar"
+	permLugaresEstado         = "lugares.estado"
+	permLugaresEditar         = "lugares.editar"
+	permEstEditar             = "estacionamientos.editar"
+	permEstEliminar           = "estacionamientos.eliminar"
+	permStaffGestionar        = "staff.gestionar"
+	permDispositivosGestionar = "dispositivos.gestionar"
+	permUsuariosRoles         = "usuarios.roles"
+)
+
+func contiene(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesUsuario devuelve los roles globales del usuario más los implícitos.
+func rolesUsuario(userID int) ([]string, error) {
+	roles := []string{rolDriver}
+	rows, err := db.Query(`
+		SELECT DISTINCT rol FROM usuario_roles WHERE user_id = ? AND estacionamiento_id = 0
+		UNION
+		SELECT ? FROM estacionamientos WHERE duenio_id = ? AND eliminado_at IS NULL
+		UNION
+		SELECT DISTINCT rol FROM usuario_roles WHERE user_id = ? AND estacionamiento_id <> 0
+		UNION
+		SELECT ? FROM estacionamiento_staff WHERE user_id = ?`,
+		userID, rolOwner, userID, userID, rolStaff, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rol string
+		if err := rows.Scan(&rol); err != nil {
+			return nil, err
+		}
+		if !contiene(roles, rol) {
+			roles = append(roles, rol)
+		}
+	}
+	return roles, rows.Err()
+}
+
+// permisosGlobales devuelve los permisos que el usuario tiene sin importar el
+// estacionamiento. Solo cuentan los roles globales (driver y los de
+// estacionamiento_id = 0); owner y staff se evalúan por estacionamiento.
+func permisosGlobales(userID int) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT rp.permiso
+		FROM rol_permisos rp
+		WHERE rp.rol = ?
+		   OR rp.rol IN (SELECT rol FROM usuario_roles WHERE user_id = ? AND estacionamiento_id = 0)`,
+		rolDriver, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var perms []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		perms = append(perms, p)
+	}
+	return perms, rows.Err()
+}
+
+// tienePermisoEn indica si el usuario tiene perm sobre el estacionamiento
+// estID por ser dueño, por un rol asignado en ese estacionamiento, por ser
+// staff con ese alcance o por un rol global con el permiso.
+func tienePermisoEn(userID, estID int, perm string) (bool, error) {
+	if ok, err := staffTienePermiso(userID, estID, perm); err != nil || ok {
+		return ok, err
+	}
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(1)
+		FROM (
+			SELECT ? AS rol FROM estacionamientos WHERE id = ? AND duenio_id = ?
+			UNION ALL
+			SELECT rol FROM usuario_roles
+			WHERE user_id = ? AND estacionamiento_id IN (0, ?)
+		) r
+		JOIN rol_permisos rp ON rp.rol = r.rol
+		WHERE rp.permiso IN (?, ?)`,
+		rolOwner, estID, userID, userID, estID, perm, permTodo,
+	).Scan(&n)
+	return n > 0, err
+}
+
+func permisosDelToken(c *gin.Context) []string {
+	v, _ := c.Get("permisos")
+	perms, _ := v.([]string)
+	return perms
+}
+
+func tokenTienePermiso(c *gin.Context, perm string) bool {
+	perms := permisosDelToken(c)
+	return contiene(perms, permTodo) || contiene(perms, perm)
+}
+
+// RequirePermission exige permisos globales (los embebidos en el JWT).
+// Va después de AuthMiddleware.
+func RequirePermission(perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, p := range perms {
+			if !tokenTienePermiso(c, p) {
+				fallar(c, errores.PermisoDenegado)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequirePermissionEn exige permisos sobre el estacionamiento que devuelve
+// estID (dueño, staff asignado o admin). Va después de AuthMiddleware.
+func RequirePermissionEn(estID func(*gin.Context) int, perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := estID(c)
+		if id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		if ok, err := estacionamientoActivo(id); err != nil || !ok {
+			if err != nil {
+				dbErr(c, err)
+				c.Abort()
+				return
+			}
+			fallar(c, errores.EstacionamientoNoEncontrado)
+			return
+		}
+		userID := c.GetInt("userID")
+		for _, p := range perms {
+			if tokenTienePermiso(c, p) {
+				continue
+			}
+			ok, err := tienePermisoEn(userID, id, p)
+			if err != nil {
+				dbErr(c, err)
+				c.Abort()
+				return
+			}
+			if !ok {
+				fallar(c, errores.NoDuenio)
+				return
+			}
+		}
+		c.Set("estacionamientoID", id)
+		c.Next()
+	}
+}
+
+// estIDParam toma el id del estacionamiento de un parámetro de ruta.
+func estIDParam(name string) func(*gin.Context) int {
+	return func(c *gin.Context) int {
+		id, _ := strconv.Atoi(c.Param(name))
+		return id
+	}
+}
+
+// estIDBody toma estacionamiento_id del cuerpo JSON sin consumirlo.
+func estIDBody(c *gin.Context) int {
+	raw, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return 0
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+	var body struct {
+		EstacionamientoID int `json:"estacionamiento_id"`
+	}
+	_ = json.Unmarshal(raw, &body)
+	return body.EstacionamientoID
+}
+
+func registrarRutasRoles(r *gin.Engine) {
+	admin := r.Group("/admin", AuthMiddleware(), RequirePermission(permUsuariosRoles))
+
+	// GET /admin/usuarios/:id/roles
+	admin.GET("/usuarios/:id/roles", func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || userID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		rows, err := db.Query(`
+			SELECT rol, estacionamiento_id FROM usuario_roles
+			WHERE user_id = ? ORDER BY estacionamiento_id, rol`, userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+
+		type Item struct {
+			Rol               string `json:"rol"`
+			EstacionamientoID int    `json:"estacionamiento_id"`
+		}
+		list := []Item{}
+		for rows.Next() {
+			var it Item
+			if err := rows.Scan(&it.Rol, &it.EstacionamientoID); err == nil {
+				list = append(list, it)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"roles": list})
+	})
+
+	// POST /admin/usuarios/:id/roles { "rol": "admin", "estacionamiento_id": 0 }
+	admin.POST("/usuarios/:id/roles", func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || userID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var body struct {
+			Rol               string `json:"rol"`
+			EstacionamientoID int    `json:"estacionamiento_id"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Rol == "" || body.EstacionamientoID < 0 {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(1) FROM roles WHERE nombre = ?`, body.Rol).Scan(&n); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if n == 0 {
+			fallar(c, errores.RolInexistente)
+			return
+		}
+		if _, err := db.Exec(`
+			INSERT IGNORE INTO usuario_roles (user_id, rol, estacionamiento_id)
+			VALUES (?, ?, ?)`, userID, body.Rol, body.EstacionamientoID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// DELETE /admin/usuarios/:id/roles { "rol": "admin", "estacionamiento_id": 0 }
+	admin.DELETE("/usuarios/:id/roles", func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || userID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var body struct {
+			Rol               string `json:"rol"`
+			EstacionamientoID int    `json:"estacionamiento_id"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Rol == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		res, err := db.Exec(`
+			DELETE FROM usuario_roles WHERE user_id = ? AND rol = ? AND estacionamiento_id = ?`,
+			userID, body.Rol, body.EstacionamientoID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			fallar(c, errores.RolNoAsignado)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- SESIONES / REFRESH TOKENS -------------
+// El access token (JWT) dura poco; el refresh token es opaco, rota en cada uso
+// y solo se guarda su hash en `sesiones`. Formato del refresh: "<sid>.<secreto>".
+
+var (
+	errSesionInvalida = errors.New("sesión inválida")
+	errRefreshReusado = errors.New("refresh token reutilizado")
+)
+
+func duracionEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️ %s inválido (%q), usando %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+func accessTokenTTL() time.Duration  { return duracionEnv("ACCESS_TOKEN_TTL", 15*time.Minute) }
+func refreshTokenTTL() time.Duration { return duracionEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour) }
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+// crearSesion registra una sesión nueva y devuelve su id y el refresh token en claro.
+func crearSesion(userID int, userAgent, ip string) (sid, refresh string, err error) {
+	if sid, err = randomToken(16); err != nil {
+		return "", "", err
+	}
+	secreto, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO sesiones (id, user_id, refresh_hash, user_agent, ip, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sid, userID, hashToken(secreto), userAgent, ip, now, now.Add(refreshTokenTTL()),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return sid, sid + "." + secreto, nil
+}
+
+// rotarSesion valida un refresh token y lo reemplaza por uno nuevo.
+// Si se presenta un refresh ya rotado se revoca la sesión entera (posible robo).
+func rotarSesion(refresh string) (userID int, sid, nuevo string, err error) {
+	sid, secreto, ok := strings.Cut(refresh, ".")
+	if !ok || sid == "" || secreto == "" {
+		return 0, "", "", errSesionInvalida
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		hash      string
+		expiresAt time.Time
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRow(`
+		SELECT user_id, refresh_hash, expires_at, revoked_at
+		FROM sesiones WHERE id = ? FOR UPDATE`, sid,
+	).Scan(&userID, &hash, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", "", errSesionInvalida
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return 0, "", "", errSesionInvalida
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(secreto))) != 1 {
+		if _, err := tx.Exec(`UPDATE sesiones SET revoked_at=? WHERE id=?`, time.Now(), sid); err != nil {
+			return 0, "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", "", err
+		}
+		return 0, "", "", errRefreshReusado
+	}
+
+	nuevoSecreto, err := randomToken(32)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if _, err := tx.Exec(
+		`UPDATE sesiones SET refresh_hash=?, last_used_at=? WHERE id=?`,
+		hashToken(nuevoSecreto), time.Now(), sid,
+	); err != nil {
+		return 0, "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", "", err
+	}
+	return userID, sid, sid + "." + nuevoSecreto, nil
+}
+
+func revocarSesion(sid string) error {
+	_, err := db.Exec(`UPDATE sesiones SET revoked_at=? WHERE id=? AND revoked_at IS NULL`, time.Now(), sid)
+	return err
+}
+
+func revocarSesionesUsuario(userID int) error {
+	_, err := db.Exec(`UPDATE sesiones SET revoked_at=? WHERE user_id=? AND revoked_at IS NULL`, time.Now(), userID)
+	return err
+}
+
+func revocarJTI(jti string, exp time.Time) error {
+	if jti == "" {
+		return nil
+	}
+	_, err := db.Exec(`INSERT IGNORE INTO jti_revocados (jti, expires_at) VALUES (?, ?)`, jti, exp)
+	return err
+}
+
+// limpiarJTIRevocados borra los jti cuyo token ya venció: a partir de ahí
+// el token se rechaza por exp y la fila no hace falta.
+func limpiarJTIRevocados(ahora time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM jti_revocados WHERE expires_at < ?`, ahora)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// iniciarLimpiezaJTI corre limpiarJTIRevocados cada JTI_LIMPIEZA_INTERVALO (1h).
+func iniciarLimpiezaJTI() {
+	intervalo := duracionEnv("JTI_LIMPIEZA_INTERVALO", time.Hour)
+	go func() {
+		for range time.Tick(intervalo) {
+			if n, err := limpiarJTIRevocados(time.Now()); err != nil {
+				log.Println("❌ Error limpiando jti revocados:", err)
+			} else if n > 0 {
+				log.Printf("🧹 %d jti revocados vencidos borrados", n)
+			}
+		}
+	}()
+}
+
+// sesionVigente indica si la sesión sigue activa y el jti no fue revocado.
+func sesionVigente(sid, jti string) (bool, error) {
+	var activa, revocado int
+	err := db.QueryRow(`
+		SELECT (s.revoked_at IS NULL AND s.expires_at > ?),
+		       (SELECT COUNT(1) FROM jti_revocados WHERE jti = ?)
+		FROM sesiones s
+		WHERE s.id = ?`, time.Now(), jti, sid,
+	).Scan(&activa, &revocado)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return activa == 1 && revocado == 0, nil
+}
+
+func buscarUsuario(userID int) (User, error) {
+	var u User
+	var vipInt int
+	err := db.QueryRow(`SELECT id, email, password_hash, vip FROM usuarios WHERE id = ? AND eliminado_at IS NULL`, userID).
+		Scan(&u.ID, &u.Email, &u.PasswordHash, &vipInt)
+	u.Vip = vipInt == 1
+	return u, err
+}
+
+// emitirAccessToken firma un JWT corto atado a la sesión sid.
+func emitirAccessToken(u User, sid string) (string, time.Time, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	roles, err := rolesUsuario(u.ID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	perms, err := permisosGlobales(u.ID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	exp := now.Add(accessTokenTTL())
+	claims := jwt.MapClaims{
+		"user_id":  u.ID,
+		"email":    u.Email,
+		"vip":      u.Vip,
+		"roles":    roles,
+		"permisos": perms,
+		"sid":      sid,
+		"jti":      jti,
+		"iat":      now.Unix(),
+		"exp":      exp.Unix(),
+	}
+	signed, err := llavesJWT.firmar(claims)
+	return signed, exp, err
+}
+
+// respuestaTokens arma el cuerpo común de /login y /token/refresh.
+func respuestaTokens(u User, sid, refresh string) (gin.H, error) {
+	access, exp, err := emitirAccessToken(u, sid)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         access,
+		"expires_in":    int(time.Until(exp).Seconds()),
+		"refresh_token": refresh,
+		"user_id":       u.ID,
+		"vip":           u.Vip,
+	}, nil
+}
+
+func registrarRutasSesiones(r *gin.Engine) {
+	// POST /token/refresh { "refresh_token": "..." }
+	r.POST("/token/refresh", func(c *gin.Context) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.RefreshToken == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+
+		userID, sid, nuevo, err := rotarSesion(body.RefreshToken)
+		if err != nil {
+			if errors.Is(err, errSesionInvalida) || errors.Is(err, errRefreshReusado) {
+				fallar(c, errores.RefreshInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+
+		u, err := buscarUsuario(userID)
+		if err != nil {
+			fallar(c, errores.RefreshInvalido)
+			return
+		}
+		resp, err := respuestaTokens(u, sid, nuevo)
+		if err != nil {
+			log.Println("❌ Error al firmar token:", err)
+			fallar(c, errores.Interno)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// POST /logout { "todos": bool } — cierra este dispositivo o todos
+	r.POST("/logout", AuthMiddleware(), func(c *gin.Context) {
+		var body struct {
+			Todos bool `json:"todos"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				fallar(c, errores.FormatoInvalido)
+				return
+			}
+		}
+
+		userID := c.GetInt("userID")
+		var err error
+		if body.Todos {
+			err = revocarSesionesUsuario(userID)
+		} else {
+			err = revocarSesion(c.GetString("sessionID"))
+		}
+		if err == nil {
+			err = revocarJTI(c.GetString("jti"), c.GetTime("tokenExp"))
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
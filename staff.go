@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- STAFF POR ESTACIONAMIENTO -------------
+// El dueño asigna empleados a un estacionamiento con un subconjunto de
+// permisos (alcance). Los permisos de gestión del estacionamiento (precios,
+// baja, staff) no se pueden delegar.
+
+// permisos que un dueño puede delegar a su staff
+var permisosStaffDelegables = []string{
+	permLugaresEstado,
+	permLugaresEditar,
+	permReservasVer,
+	permReservasGestionar,
+}
+
+// alcance por defecto de un staff recién invitado
+var permisosStaffDefault = []string{permLugaresEstado, permReservasVer}
+
+// las invitaciones vencen si no se aceptan en este tiempo
+const staffInvitacionVigencia = 14 * 24 * time.Hour
+
+// aceptarInvitacionesStaff pasa a estacionamiento_staff las invitaciones
+// vigentes para email (solo la de estID si no es 0) y devuelve cuántas.
+// Se llama cuando el usuario demostró que el email es suyo.
+func aceptarInvitacionesStaff(q consultor, userID int, email string, estID int) (int64, error) {
+	email = normalizarEmail(email)
+	filtro, args := `i.email = ? AND i.created_at > ?`, []interface{}{email, time.Now().Add(-staffInvitacionVigencia)}
+	if estID > 0 {
+		filtro, args = filtro+` AND i.estacionamiento_id = ?`, append(args, estID)
+	}
+	res, err := q.Exec(`
+		INSERT INTO estacionamiento_staff (estacionamiento_id, user_id, permisos, invitado_por)
+		SELECT i.estacionamiento_id, ?, i.permisos, i.invitado_por
+		FROM staff_invitaciones i
+		JOIN estacionamientos e ON e.id = i.estacionamiento_id AND e.eliminado_at IS NULL AND e.duenio_id <> ?
+		WHERE `+filtro+`
+		ON DUPLICATE KEY UPDATE permisos = VALUES(permisos)`,
+		append([]interface{}{userID, userID}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	borrar, bArgs := `DELETE FROM staff_invitaciones WHERE email = ?`, []interface{}{email}
+	if estID > 0 {
+		borrar, bArgs = borrar+` AND estacionamiento_id = ?`, append(bArgs, estID)
+	}
+	_, err = q.Exec(borrar, bArgs...)
+	return n, err
+}
+
+// staffTienePermiso indica si userID es staff de estID con perm en su alcance.
+func staffTienePermiso(userID, estID int, perm string) (bool, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(1) FROM estacionamiento_staff
+		WHERE estacionamiento_id = ? AND user_id = ? AND FIND_IN_SET(?, permisos) > 0`,
+		estID, userID, perm,
+	).Scan(&n)
+	return n > 0, err
+}
+
+func normalizarPermisosStaff(in []string) ([]string, bool) {
+	if len(in) == 0 {
+		return permisosStaffDefault, true
+	}
+	out := make([]string, 0, len(in))
+	for _, p := range in {
+		if !contiene(permisosStaffDelegables, p) {
+			return nil, false
+		}
+		if !contiene(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out, true
+}
+
+func registrarRutasStaff(r *gin.Engine) {
+	gestion := RequirePermissionEn(estIDParam("id"), permStaffGestionar)
+
+	// POST /estacionamientos/:id/staff { "email": "...", "permisos": ["lugares.estado"] }
+	// Deja una invitación y la manda por mail; el invitado la acepta desde su
+	// cuenta (POST /staff/invitaciones/:id/aceptar) o, si todavía no tiene,
+	// al registrarse y verificar ese email. Invitar de nuevo reemplaza el
+	// alcance. La respuesta es la misma tenga o no cuenta el email, para no
+	// revelar cuáles están registrados.
+	r.POST("/estacionamientos/:id/staff", AuthMiddleware(), gestion, func(c *gin.Context) {
+		estID := c.GetInt("estacionamientoID")
+		var body struct {
+			Email    string   `json:"email" binding:"required,email,max=255"`
+			Permisos []string `json:"permisos"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		email := normalizarEmail(body.Email)
+		perms, ok := normalizarPermisosStaff(body.Permisos)
+		if !ok {
+			errores.Responder(c, errores.Nuevo(errores.PermisoNoDelegable).Con("permitidos", permisosStaffDelegables))
+			return
+		}
+
+		var nombre, emailDuenio string
+		if err := db.QueryRow(`
+			SELECT e.nombre, IFNULL(u.email, '') FROM estacionamientos e
+			LEFT JOIN usuarios u ON u.id = e.duenio_id
+			WHERE e.id = ?`, estID).Scan(&nombre, &emailDuenio); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if email == normalizarEmail(emailDuenio) {
+			fallar(c, errores.DuenioNoPuedeStaff)
+			return
+		}
+
+		if _, err := db.Exec(`
+			INSERT INTO staff_invitaciones (estacionamiento_id, email, permisos, invitado_por, created_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE permisos = VALUES(permisos), invitado_por = VALUES(invitado_por), created_at = VALUES(created_at)`,
+			estID, email, strings.Join(perms, ","), c.GetInt("userID"), time.Now(),
+		); err != nil {
+			dbErr(c, err)
+			return
+		}
+		enviarMail(email, "Te invitaron a "+nombre,
+			"Te invitaron a trabajar en el estacionamiento "+nombre+".\n\n"+
+				"Si ya tenés cuenta con este email, aceptá la invitación desde "+appURL()+"/staff/invitaciones. "+
+				"Si no, creá tu cuenta en "+appURL()+"/register y confirmá el email: la invitación se acepta sola.\n\n"+
+				"La invitación vence en 14 días.")
+		c.JSON(http.StatusAccepted, gin.H{"email": email, "permisos": perms})
+	})
+
+	// GET /estacionamientos/:id/staff
+	r.GET("/estacionamientos/:id/staff", AuthMiddleware(), gestion, func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT s.user_id, u.email, s.permisos, s.created_at
+			FROM estacionamiento_staff s
+			JOIN usuarios u ON u.id = s.user_id
+			WHERE s.estacionamiento_id = ?
+			ORDER BY u.email`, c.GetInt("estacionamientoID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+
+		type Item struct {
+			UserID   int      `json:"user_id"`
+			Email    string   `json:"email"`
+			Permisos []string `json:"permisos"`
+			Desde    string   `json:"desde"`
+		}
+		list := []Item{}
+		for rows.Next() {
+			var it Item
+			var perms string
+			var desde sql.NullTime
+			if err := rows.Scan(&it.UserID, &it.Email, &perms, &desde); err == nil {
+				it.Permisos = strings.Split(perms, ",")
+				if desde.Valid {
+					it.Desde = desde.Time.Format(time.RFC3339)
+				}
+				list = append(list, it)
+			}
+		}
+
+		// las invitaciones pendientes van aparte y sin user_id
+		type Invitacion struct {
+			Email    string   `json:"email"`
+			Permisos []string `json:"permisos"`
+			Vence    string   `json:"vence"`
+		}
+		invs, err := db.Query(`
+			SELECT email, permisos, created_at FROM staff_invitaciones
+			WHERE estacionamiento_id = ? AND created_at > ?
+			ORDER BY email`, c.GetInt("estacionamientoID"), time.Now().Add(-staffInvitacionVigencia))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer invs.Close()
+		pendientes := []Invitacion{}
+		for invs.Next() {
+			var (
+				inv    Invitacion
+				perms  string
+				creada time.Time
+			)
+			if err := invs.Scan(&inv.Email, &perms, &creada); err == nil {
+				inv.Permisos = strings.Split(perms, ",")
+				inv.Vence = creada.Add(staffInvitacionVigencia).Format(time.RFC3339)
+				pendientes = append(pendientes, inv)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"staff": list, "invitaciones": pendientes})
+	})
+
+	// DELETE /estacionamientos/:id/staff/:userId
+	r.DELETE("/estacionamientos/:id/staff/:userId", AuthMiddleware(), gestion, func(c *gin.Context) {
+		staffID, err := strconv.Atoi(c.Param("userId"))
+		if err != nil || staffID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		res, err := db.Exec(`
+			DELETE FROM estacionamiento_staff WHERE estacionamiento_id = ? AND user_id = ?`,
+			c.GetInt("estacionamientoID"), staffID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			fallar(c, errores.StaffNoEncontrado)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// GET /staff/invitaciones — invitaciones pendientes para mi email
+	r.GET("/staff/invitaciones", AuthMiddleware(), func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT e.id, e.nombre, i.permisos
+			FROM staff_invitaciones i
+			JOIN usuarios u ON u.email = i.email AND u.id = ? AND u.email_verificado = 1
+			JOIN estacionamientos e ON e.id = i.estacionamiento_id AND e.eliminado_at IS NULL
+			WHERE i.created_at > ?
+			ORDER BY e.nombre`, c.GetInt("userID"), time.Now().Add(-staffInvitacionVigencia))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+
+		type Item struct {
+			EstacionamientoID int      `json:"estacionamiento_id"`
+			Nombre            string   `json:"nombre"`
+			Permisos          []string `json:"permisos"`
+		}
+		list := []Item{}
+		for rows.Next() {
+			var it Item
+			var perms string
+			if err := rows.Scan(&it.EstacionamientoID, &it.Nombre, &perms); err == nil {
+				it.Permisos = strings.Split(perms, ",")
+				list = append(list, it)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"invitaciones": list})
+	})
+
+	// POST /staff/invitaciones/:id/aceptar — :id es el estacionamiento. Pide
+	// el email verificado: si no, cualquiera que se registre con un email
+	// ajeno podría tomar sus invitaciones.
+	r.POST("/staff/invitaciones/:id/aceptar", AuthMiddleware(), func(c *gin.Context) {
+		estID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || estID <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		userID := c.GetInt("userID")
+		var (
+			email      string
+			verificado int
+		)
+		if err := db.QueryRow(`SELECT email, email_verificado FROM usuarios WHERE id = ?`, userID).
+			Scan(&email, &verificado); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if verificado != 1 {
+			fallar(c, errores.EmailNoVerificado)
+			return
+		}
+		n, err := aceptarInvitacionesStaff(db, userID, email, estID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if n == 0 {
+			fallar(c, errores.SinInvitacion)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// GET /staff/estacionamientos — estacionamientos donde trabajo
+	r.GET("/staff/estacionamientos", AuthMiddleware(), func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT e.id, e.nombre, s.permisos
+			FROM estacionamiento_staff s
+			JOIN estacionamientos e ON e.id = s.estacionamiento_id AND e.eliminado_at IS NULL
+			WHERE s.user_id = ?
+			ORDER BY e.nombre`, c.GetInt("userID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+
+		type Item struct {
+			ID       int      `json:"id"`
+			Nombre   string   `json:"nombre"`
+			Permisos []string `json:"permisos"`
+		}
+		list := []Item{}
+		for rows.Next() {
+			var it Item
+			var perms string
+			if err := rows.Scan(&it.ID, &it.Nombre, &perms); err == nil {
+				it.Permisos = strings.Split(perms, ",")
+				list = append(list, it)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"estacionamientos": list})
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- TARIFAS -------------
+// Cada estacionamiento tiene versiones de reglas de cobro por tipo de vehículo:
+// un primer bloque (p.ej. la primera hora), fracciones después (cada 15 min),
+// precio nocturno por franja horaria, tope cada 24 h de estadía y pases
+// (semanal, mensual). Una versión nueva no pisa a la anterior: se cotiza con
+// la vigente a la hora de entrada. Sin versiones cargadas se usa
+// precio_por_hora como tarifa plana por hora.
+
+const (
+	primerBloqueDefault = 60
+	fraccionDefault     = 15
+	monedaDefault       = "ARS"
+	estadiaMaximaDias   = 366
+)
+
+type TarifaNocturna struct {
+	Desde        string   `json:"desde" binding:"required,hora"`
+	Hasta        string   `json:"hasta" binding:"required,hora"`
+	PrimerBloque *float64 `json:"primer_bloque" binding:"omitempty,min=0"`
+	Fraccion     float64  `json:"fraccion" binding:"min=0"`
+}
+
+type PaseTarifa struct {
+	Nombre string  `json:"nombre" binding:"required,max=50"`
+	Dias   int     `json:"dias" binding:"required,min=1,max=366"`
+	Precio float64 `json:"precio" binding:"min=0"`
+}
+
+type TarifaTipo struct {
+	PrimerBloque    float64         `json:"primer_bloque" binding:"min=0"`
+	PrimerBloqueMin int             `json:"primer_bloque_min" binding:"omitempty,min=1,max=1440"`
+	Fraccion        float64         `json:"fraccion" binding:"min=0"`
+	FraccionMin     int             `json:"fraccion_min" binding:"omitempty,min=1,max=1440"`
+	Nocturna        *TarifaNocturna `json:"nocturna"`
+	TopeDiario      *float64        `json:"tope_diario" binding:"omitempty,gt=0"`
+	Pases           []PaseTarifa    `json:"pases" binding:"omitempty,max=10,dive"`
+}
+
+type ReglasTarifa struct {
+	Moneda string                `json:"moneda" binding:"omitempty,len=3"`
+	Tipos  map[string]TarifaTipo `json:"tipos" binding:"required,min=1,dive,keys,oneof=auto moto camioneta,endkeys"`
+}
+
+// normalizar completa los valores por defecto.
+func (rt *ReglasTarifa) normalizar() {
+	if rt.Moneda == "" {
+		rt.Moneda = monedaDefault
+	}
+	rt.Moneda = strings.ToUpper(rt.Moneda)
+	for tipo, tt := range rt.Tipos {
+		if tt.PrimerBloqueMin == 0 {
+			tt.PrimerBloqueMin = primerBloqueDefault
+		}
+		if tt.FraccionMin == 0 {
+			tt.FraccionMin = fraccionDefault
+		}
+		if tt.Nocturna != nil {
+			tt.Nocturna.Desde, tt.Nocturna.Hasta = horaHHMM(tt.Nocturna.Desde), horaHHMM(tt.Nocturna.Hasta)
+		}
+		if tt.Pases == nil {
+			tt.Pases = []PaseTarifa{}
+		}
+		rt.Tipos[tipo] = tt
+	}
+}
+
+// tarifaPlana arma las reglas equivalentes a precio_por_hora.
+func tarifaPlana(precio float64) ReglasTarifa {
+	rt := ReglasTarifa{Moneda: monedaDefault, Tipos: map[string]TarifaTipo{}}
+	for _, tipo := range tiposVehiculo {
+		rt.Tipos[tipo] = TarifaTipo{PrimerBloque: precio, PrimerBloqueMin: 60, Fraccion: precio, FraccionMin: 60}
+	}
+	rt.normalizar()
+	return rt
+}
+
+// incluye indica si t cae en la franja nocturna (puede cruzar la medianoche).
+func (n *TarifaNocturna) incluye(t time.Time) bool {
+	if n == nil {
+		return false
+	}
+	ini, dur, ok := tramo(n.Desde, n.Hasta)
+	if !ok {
+		return false
+	}
+	t = t.In(zonaHoraria)
+	m := t.Hour()*60 + t.Minute()
+	return (m-ini+minutosDia)%minutosDia < dur
+}
+
+type itemCotizacion struct {
+	Concepto string  `json:"concepto"`
+	Cantidad int     `json:"cantidad"`
+	Importe  float64 `json:"importe"`
+}
+
+func redondear(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// cotizar calcula el importe de [entrada, salida). El primer bloque se cobra
+// entero aunque la estadía sea más corta; después se cobra cada fracción
+// empezada, nocturna si empieza en la franja. El tope se aplica a cada 24 h
+// desde la entrada. Si un pase sale más barato se cobra el pase.
+func (tt TarifaTipo) cotizar(entrada, salida time.Time) (float64, []itemCotizacion, *string) {
+	minutos := int(math.Ceil(salida.Sub(entrada).Minutes()))
+	var (
+		total, impDia, impNoche, descuento float64
+		primero                            float64
+		nDia, nNoche                       int
+	)
+	m := 0
+	for ini := 0; ini < minutos; ini += minutosDia {
+		fin := ini + minutosDia
+		if fin > minutos {
+			fin = minutos
+		}
+		sub := 0.0
+		if ini == 0 {
+			primero = tt.PrimerBloque
+			if tt.Nocturna != nil && tt.Nocturna.PrimerBloque != nil && tt.Nocturna.incluye(entrada) {
+				primero = *tt.Nocturna.PrimerBloque
+			}
+			sub += primero
+			m = tt.PrimerBloqueMin
+		}
+		for ; m < fin; m += tt.FraccionMin {
+			if tt.Nocturna.incluye(entrada.Add(time.Duration(m) * time.Minute)) {
+				sub += tt.Nocturna.Fraccion
+				impNoche += tt.Nocturna.Fraccion
+				nNoche++
+			} else {
+				sub += tt.Fraccion
+				impDia += tt.Fraccion
+				nDia++
+			}
+		}
+		if tt.TopeDiario != nil && sub > *tt.TopeDiario {
+			descuento += sub - *tt.TopeDiario
+			sub = *tt.TopeDiario
+		}
+		total += sub
+	}
+
+	detalle := []itemCotizacion{{fmt.Sprintf("primer bloque (%d min)", tt.PrimerBloqueMin), 1, redondear(primero)}}
+	if nDia > 0 {
+		detalle = append(detalle, itemCotizacion{fmt.Sprintf("fracción diurna (%d min)", tt.FraccionMin), nDia, redondear(impDia)})
+	}
+	if nNoche > 0 {
+		detalle = append(detalle, itemCotizacion{fmt.Sprintf("fracción nocturna (%d min)", tt.FraccionMin), nNoche, redondear(impNoche)})
+	}
+	if descuento > 0 {
+		detalle = append(detalle, itemCotizacion{"tope diario", 1, -redondear(descuento)})
+	}
+
+	var pase *string
+	for _, p := range tt.Pases {
+		n := int(math.Ceil(float64(minutos) / float64(p.Dias*minutosDia)))
+		if imp := float64(n) * p.Precio; imp < total {
+			total = imp
+			nombre := p.Nombre
+			pase = &nombre
+			detalle = []itemCotizacion{{"pase " + p.Nombre, n, redondear(imp)}}
+		}
+	}
+	return redondear(total), detalle, pase
+}
+
+// versionTarifa es una fila de tarifas. Version 0 es la tarifa plana
+// derivada de precio_por_hora.
+type versionTarifa struct {
+	Version      int       `json:"version"`
+	VigenteDesde time.Time `json:"vigente_desde"`
+	ReglasTarifa
+}
+
+// tarifaVigente devuelve la versión vigente en t o, si no hay, la plana de
+// precio_por_hora. ok=false si no hay ninguna.
+func tarifaVigente(estID int, t time.Time) (versionTarifa, bool, error) {
+	var (
+		vt     versionTarifa
+		reglas string
+	)
+	err := db.QueryRow(`
+		SELECT version, vigente_desde, reglas FROM tarifas
+		WHERE estacionamiento_id = ? AND vigente_desde <= ?
+		ORDER BY vigente_desde DESC, version DESC LIMIT 1`, estID, t,
+	).Scan(&vt.Version, &vt.VigenteDesde, &reglas)
+	if err == nil {
+		if err := json.Unmarshal([]byte(reglas), &vt.ReglasTarifa); err != nil {
+			return vt, false, err
+		}
+		vt.normalizar()
+		return vt, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return vt, false, err
+	}
+
+	var precio sql.NullFloat64
+	if err := db.QueryRow(`SELECT precio_por_hora FROM estacionamientos WHERE id = ?`, estID).Scan(&precio); err != nil || !precio.Valid {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return vt, false, err
+	}
+	return versionTarifa{ReglasTarifa: tarifaPlana(precio.Float64)}, true, nil
+}
+
+func tiposConTarifa(rt ReglasTarifa) []string {
+	out := make([]string, 0, len(rt.Tipos))
+	for t := range rt.Tipos {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func registrarRutasTarifas(r *gin.Engine) {
+	editar := RequirePermissionEn(estIDParam("id"), permEstEditar)
+
+	// GET /estacionamientos/:id/tarifas: todas las versiones, la más nueva primero
+	r.GET("/estacionamientos/:id/tarifas", AuthMiddleware(), editar, func(c *gin.Context) {
+		rows, err := db.Query(`
+			SELECT version, vigente_desde, reglas FROM tarifas
+			WHERE estacionamiento_id = ? ORDER BY version DESC`, c.GetInt("estacionamientoID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+		list := []versionTarifa{}
+		for rows.Next() {
+			var (
+				vt     versionTarifa
+				reglas string
+			)
+			if err := rows.Scan(&vt.Version, &vt.VigenteDesde, &reglas); err != nil {
+				dbErr(c, err)
+				return
+			}
+			if err := json.Unmarshal([]byte(reglas), &vt.ReglasTarifa); err != nil {
+				dbErr(c, err)
+				return
+			}
+			vt.normalizar()
+			list = append(list, vt)
+		}
+		c.JSON(http.StatusOK, gin.H{"tarifas": list})
+	})
+
+	// POST /estacionamientos/:id/tarifas
+	// { "vigente_desde"?: "2026-11-01T00:00:00-03:00", "moneda"?: "ARS",
+	//   "tipos": { "auto": { "primer_bloque": 1200, "fraccion": 300, "fraccion_min": 15,
+	//              "nocturna": { "desde": "20:00", "hasta": "08:00", "fraccion": 200 },
+	//              "tope_diario": 9000, "pases": [{ "nombre": "semanal", "dias": 7, "precio": 40000 }] } } }
+	// Crea una versión nueva; sin vigente_desde rige desde ahora.
+	r.POST("/estacionamientos/:id/tarifas", AuthMiddleware(), editar, func(c *gin.Context) {
+		var in struct {
+			VigenteDesde *time.Time `json:"vigente_desde"`
+			ReglasTarifa
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		ahora := time.Now()
+		if in.VigenteDesde == nil {
+			in.VigenteDesde = &ahora
+		} else if in.VigenteDesde.Before(ahora.Add(-time.Minute)) {
+			responderInvalidos(c, []errorValidacion{{Campo: "vigente_desde", Motivo: "no puede ser anterior a ahora"}})
+			return
+		}
+		in.normalizar()
+		reglas, err := json.Marshal(in.ReglasTarifa)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+
+		estID := c.GetInt("estacionamientoID")
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+		// el lock serializa la numeración de versiones
+		var version int
+		if err := tx.QueryRow(`SELECT id FROM estacionamientos WHERE id = ? FOR UPDATE`, estID).Scan(&version); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := tx.QueryRow(`SELECT IFNULL(MAX(version), 0) + 1 FROM tarifas WHERE estacionamiento_id = ?`, estID).Scan(&version); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO tarifas (estacionamiento_id, version, reglas, vigente_desde, created_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			estID, version, string(reglas), *in.VigenteDesde, c.GetInt("userID"), ahora); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		fmt.Printf("💲 Tarifa v%d del estacionamiento %d\n", version, estID)
+		c.JSON(http.StatusCreated, versionTarifa{Version: version, VigenteDesde: *in.VigenteDesde, ReglasTarifa: in.ReglasTarifa})
+	})
+
+	// POST /estacionamientos/:id/cotizar
+	// { "entrada": "2026-10-16T18:30:00-03:00", "salida": "2026-10-16T21:10:00-03:00", "tipo_vehiculo"?: "auto" }
+	r.POST("/estacionamientos/:id/cotizar", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var in struct {
+			Entrada      time.Time `json:"entrada" binding:"required"`
+			Salida       time.Time `json:"salida" binding:"required,gtfield=Entrada"`
+			TipoVehiculo string    `json:"tipo_vehiculo" binding:"omitempty,oneof=auto moto camioneta"`
+		}
+		if !bindJSON(c, &in) {
+			return
+		}
+		if in.Salida.Sub(in.Entrada) > estadiaMaximaDias*24*time.Hour {
+			responderInvalidos(c, []errorValidacion{{Campo: "salida", Motivo: fmt.Sprintf("la estadía máxima es de %d días", estadiaMaximaDias)}})
+			return
+		}
+		if in.TipoVehiculo == "" {
+			in.TipoVehiculo = "auto"
+		}
+
+		if ok, err := estacionamientoActivo(id); err != nil || !ok {
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			fallar(c, errores.EstacionamientoNoEncontrado)
+			return
+		}
+		vt, ok, err := tarifaVigente(id, in.Entrada)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if !ok {
+			fallar(c, errores.TarifaNoEncontrada)
+			return
+		}
+		tt, ok := vt.Tipos[in.TipoVehiculo]
+		if !ok {
+			responderInvalidos(c, []errorValidacion{{Campo: "tipo_vehiculo", Motivo: "sin tarifa; tipos con tarifa: " + strings.Join(tiposConTarifa(vt.ReglasTarifa), ", ")}})
+			return
+		}
+
+		importe, detalle, pase := tt.cotizar(in.Entrada, in.Salida)
+		c.JSON(http.StatusOK, gin.H{
+			"version":       vt.Version,
+			"moneda":        vt.Moneda,
+			"tipo_vehiculo": in.TipoVehiculo,
+			"entrada":       in.Entrada,
+			"salida":        in.Salida,
+			"minutos":       int(math.Ceil(in.Salida.Sub(in.Entrada).Minutes())),
+			"importe":       importe,
+			"pase":          pase,
+			"detalle":       detalle,
+		})
+	})
+}
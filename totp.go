@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ----------- TOTP (RFC 6238) -------------
+// HMAC-SHA1, 6 dígitos, pasos de 30 segundos; se acepta un paso de desfasaje.
+
+const (
+	totpPeriodo = 30
+	totpDigitos = 6
+	totpVentana = 1
+)
+
+var base32SinPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func nuevoSecretoTOTP() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32SinPadding.EncodeToString(b), nil
+}
+
+func totpURI(issuer, cuenta, secreto string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(cuenta)
+	q := url.Values{}
+	q.Set("secret", secreto)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigitos))
+	q.Set("period", fmt.Sprint(totpPeriodo))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// codigoHOTP implementa RFC 4226 para el contador dado.
+func codigoHOTP(secreto []byte, contador uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], contador)
+	mac := hmac.New(sha1.New, secreto)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigitos, bin%1000000)
+}
+
+// validarTOTP devuelve el paso que coincidió con codigo. Pasos menores o
+// iguales a ultimoPaso se rechazan para que un código no se pueda reusar.
+func validarTOTP(secreto, codigo string, ahora time.Time, ultimoPaso int64) (int64, bool) {
+	key, err := base32SinPadding.DecodeString(strings.ToUpper(secreto))
+	if err != nil {
+		return 0, false
+	}
+	codigo = strings.ReplaceAll(strings.TrimSpace(codigo), " ", "")
+	if len(codigo) != totpDigitos {
+		return 0, false
+	}
+	paso := ahora.Unix() / totpPeriodo
+	for d := int64(-totpVentana); d <= totpVentana; d++ {
+		p := paso + d
+		if p <= ultimoPaso {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(codigoHOTP(key, uint64(p))), []byte(codigo)) == 1 {
+			return p, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- VALIDACIÓN -------------
+// Las reglas se declaran con tags `binding:"..."` en los tipos de request y
+// las aplica gin al bindear. bindJSON responde 422 con la lista de campos
+// inválidos y el motivo de cada uno.
+
+var diasSemana = []string{"lunes", "martes", "miercoles", "jueves", "viernes", "sabado", "domingo"}
+
+var reHora = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d(:[0-5]\d)?$|^24:00(:00)?$`)
+
+// reTelefono acepta "+54 11 4321-5678", "(011) 4321 5678", etc.
+var reTelefono = regexp.MustCompile(`^\+?[0-9 ()-]+$`)
+
+// normalizarDia pasa a minúsculas y sin tildes ("Miércoles" -> "miercoles").
+func normalizarDia(d string) string {
+	r := strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u")
+	return r.Replace(strings.ToLower(strings.TrimSpace(d)))
+}
+
+// normalizarEmail es la forma en que se guardan y se buscan los emails:
+// sin espacios alrededor y en minúsculas, así "User@x.com" y "user@x.com"
+// son la misma cuenta.
+func normalizarEmail(e string) string {
+	return strings.ToLower(strings.TrimSpace(e))
+}
+
+// passwordValida exige 8 a 72 caracteres (bcrypt ignora el resto) con al
+// menos una letra y un número.
+func passwordValida(p string) bool {
+	if len(p) < 8 || len(p) > 72 {
+		return false
+	}
+	var letra, numero bool
+	for _, r := range p {
+		switch {
+		case unicode.IsLetter(r):
+			letra = true
+		case unicode.IsDigit(r):
+			numero = true
+		}
+	}
+	return letra && numero
+}
+
+// telefonoValido pide el formato de reTelefono y entre 6 y 15 dígitos (E.164).
+func telefonoValido(t string) bool {
+	t = strings.TrimSpace(t)
+	if !reTelefono.MatchString(t) {
+		return false
+	}
+	digitos := 0
+	for _, r := range t {
+		if r >= '0' && r <= '9' {
+			digitos++
+		}
+	}
+	return digitos >= 6 && digitos <= 15
+}
+
+// horaHHMM deja "9:00", "9:00:00" o "09:00:00" como "09:00" (y "24:00:00"
+// como "24:00", el fin del día). Lo que no es una hora vuelve sin cambios
+// para que lo rechace reHora.
+func horaHHMM(h string) string {
+	h = strings.TrimSpace(h)
+	for _, f := range []string{"15:04", "15:04:05"} {
+		if t, err := time.Parse(f, h); err == nil {
+			return t.Format("15:04")
+		}
+	}
+	if h == "24:00:00" {
+		return "24:00"
+	}
+	return h
+}
+
+func registrarValidaciones() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	// los errores usan el nombre JSON del campo
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	_ = v.RegisterValidation("dia", func(fl validator.FieldLevel) bool {
+		return len(diasDeTexto(fl.Field().String())) > 0
+	})
+	_ = v.RegisterValidation("hora", func(fl validator.FieldLevel) bool {
+		return reHora.MatchString(horaHHMM(fl.Field().String()))
+	})
+	_ = v.RegisterValidation("password", func(fl validator.FieldLevel) bool {
+		return passwordValida(fl.Field().String())
+	})
+	// rechaza los textos que son solo espacios, que required deja pasar
+	_ = v.RegisterValidation("novacio", func(fl validator.FieldLevel) bool {
+		return strings.TrimSpace(fl.Field().String()) != ""
+	})
+	// se valida ya normalizada, como se guarda
+	_ = v.RegisterValidation("patente", func(fl validator.FieldLevel) bool {
+		return rePatente.MatchString(normalizarPatente(fl.Field().String()))
+	})
+	// vacío vale: es como se borra el teléfono en PATCH /me
+	_ = v.RegisterValidation("telefono", func(fl validator.FieldLevel) bool {
+		t := fl.Field().String()
+		return strings.TrimSpace(t) == "" || telefonoValido(t)
+	})
+}
+
+type errorValidacion struct {
+	Campo  string `json:"campo"`
+	Motivo string `json:"motivo"`
+}
+
+func motivoValidacion(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required", "novacio":
+		return "obligatorio"
+	case "email":
+		return "email inválido"
+	case "min", "gte":
+		if fe.Kind() == reflect.String || fe.Kind() == reflect.Slice {
+			return "largo mínimo " + fe.Param()
+		}
+		return "debe ser mayor o igual a " + fe.Param()
+	case "max", "lte":
+		if fe.Kind() == reflect.String || fe.Kind() == reflect.Slice {
+			return "largo máximo " + fe.Param()
+		}
+		return "debe ser menor o igual a " + fe.Param()
+	case "gt":
+		return "debe ser mayor a " + fe.Param()
+	case "len":
+		return "largo " + fe.Param()
+	case "gtfield":
+		return "debe ser posterior a " + strings.ToLower(fe.Param())
+	case "oneof":
+		return "debe ser uno de: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "dia":
+		return "día inválido: un día (" + strings.Join(diasSemana, ", ") + "), un rango (lunes a viernes) o todos"
+	case "hora":
+		return "hora inválida, formato HH:MM"
+	case "password":
+		return "entre 8 y 72 caracteres, con al menos una letra y un número"
+	case "patente":
+		return "patente inválida"
+	case "telefono":
+		return "teléfono inválido: entre 6 y 15 dígitos, con + ( ) - o espacios"
+	}
+	return fmt.Sprintf("no cumple %s", fe.Tag())
+}
+
+// erroresValidacion arma la lista de campos inválidos. El namespace empieza
+// con el nombre del tipo, que no le sirve al cliente.
+func erroresValidacion(ve validator.ValidationErrors) []errorValidacion {
+	out := make([]errorValidacion, 0, len(ve))
+	for _, fe := range ve {
+		campo := fe.Namespace()
+		if i := strings.Index(campo, "."); i >= 0 {
+			campo = campo[i+1:]
+		}
+		out = append(out, errorValidacion{Campo: campo, Motivo: motivoValidacion(fe)})
+	}
+	return out
+}
+
+func responderInvalidos(c *gin.Context, campos []errorValidacion) {
+	errores.Responder(c, errores.Nuevo(errores.DatosInvalidos).Con("campos", campos))
+}
+
+// bindJSON decodifica y valida el cuerpo. Si falla responde 400 (JSON mal
+// formado) o 422 (campos inválidos) y devuelve false.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	var ve validator.ValidationErrors
+	if errors.As(err, &ve) {
+		responderInvalidos(c, erroresValidacion(ve))
+		return false
+	}
+	fallar(c, errores.FormatoInvalido)
+	return false
+}
+
+// validarStruct aplica las mismas reglas a un valor que no vino de bindJSON.
+func validarStruct(obj interface{}) []errorValidacion {
+	err := binding.Validator.ValidateStruct(obj)
+	var ve validator.ValidationErrors
+	if errors.As(err, &ve) {
+		return erroresValidacion(ve)
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- VEHÍCULOS -------------
+// Cada usuario registra sus vehículos (patente, tipo, altura, eléctrico). Las
+// reservas y los ingresos referencian un vehículo y se rechazan si no entra
+// por altura (altura_max_m) o si no hay lugares para su tipo.
+
+var tiposVehiculo = []string{"auto", "moto", "camioneta"}
+
+var (
+	errVehiculoInexistente = errors.New("vehículo inexistente")
+	errVehiculoAlto        = errors.New("el vehículo supera la altura máxima del estacionamiento")
+	errVehiculoTipo        = errors.New("no hay lugares para este tipo de vehículo")
+)
+
+type Vehiculo struct {
+	ID        int      `json:"id"`
+	Patente   string   `json:"patente"`
+	Tipo      string   `json:"tipo"`
+	AlturaM   *float64 `json:"altura_m"`
+	Electrico bool     `json:"electrico"`
+	Alias     *string  `json:"alias"`
+}
+
+// scanVehiculo lee columnasVehiculo y, en extra, las columnas que la
+// consulta agregue después.
+func scanVehiculo(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Vehiculo, error) {
+	var (
+		v      Vehiculo
+		altura sql.NullFloat64
+		alias  sql.NullString
+		ev     int
+	)
+	if err := row.Scan(append([]interface{}{&v.ID, &v.Patente, &v.Tipo, &altura, &ev, &alias}, extra...)...); err != nil {
+		return v, err
+	}
+	if altura.Valid {
+		v.AlturaM = &altura.Float64
+	}
+	v.Alias = nullStringPtr(alias)
+	v.Electrico = ev == 1
+	return v, nil
+}
+
+const columnasVehiculo = `id, patente, tipo, altura_m, electrico, alias`
+
+func vehiculoDeUsuario(userID, vehiculoID int) (Vehiculo, error) {
+	v, err := scanVehiculo(db.QueryRow(`SELECT `+columnasVehiculo+` FROM vehiculos WHERE id = ? AND user_id = ?`, vehiculoID, userID))
+	if err == sql.ErrNoRows {
+		return v, errVehiculoInexistente
+	}
+	return v, err
+}
+
+// vehiculoPorDefecto devuelve el id del único vehículo del usuario (0 si no
+// tiene o tiene varios y hay que elegir).
+func vehiculoPorDefecto(userID int) (int, error) {
+	var n, id int
+	err := db.QueryRow(`SELECT COUNT(1), IFNULL(MIN(id), 0) FROM vehiculos WHERE user_id = ?`, userID).Scan(&n, &id)
+	if err != nil || n != 1 {
+		return 0, err
+	}
+	return id, nil
+}
+
+// patentesConReservas devuelve las patentes de los vehículos del usuario que
+// cumplen filtro (sobre vehiculos v) y tienen reservas que todavía no
+// terminaron: borrarlos dejaría esas reservas sin vehículo para detectar la
+// llegada.
+func patentesConReservas(q consultor, userID int, filtro string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT DISTINCT v.patente FROM vehiculos v
+		JOIN reservas r ON r.vehiculo_id = v.id AND r.estado IN (?, ?, ?)
+		WHERE v.user_id = ? AND `+filtro+`
+		ORDER BY v.patente`,
+		append([]interface{}{reservaPendiente, reservaConfirmada, reservaEnCurso, userID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// validarVehiculoEnEstacionamiento controla altura y que haya lugares
+// compatibles con el tipo. Si numero > 0 se controla ese lugar puntual.
+func validarVehiculoEnEstacionamiento(v Vehiculo, estID, numero int) error {
+	var altura sql.NullFloat64
+	if err := db.QueryRow(`SELECT altura_max_m FROM estacionamientos WHERE id = ?`, estID).Scan(&altura); err != nil {
+		return err
+	}
+	if altura.Valid && v.AlturaM != nil && *v.AlturaM > altura.Float64 {
+		return errVehiculoAlto
+	}
+
+	q := `SELECT COUNT(1) FROM lugares WHERE estacionamiento_id = ? AND (tipo IS NULL OR tipo = ?)`
+	args := []interface{}{estID, v.Tipo}
+	if numero > 0 {
+		q += ` AND numero = ?`
+		args = append(args, numero)
+	}
+	var n int
+	if err := db.QueryRow(q, args...).Scan(&n); err != nil {
+		return err
+	}
+	// sin lugares cargados no hay contra qué comparar
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM lugares WHERE estacionamiento_id = ?`, estID).Scan(&total); err != nil {
+		return err
+	}
+	if total > 0 && n == 0 {
+		return errVehiculoTipo
+	}
+	return nil
+}
+
+// errorVehiculoJSON responde los errores de validación de vehículos; devuelve
+// false si err no es uno de ellos.
+func errorVehiculoJSON(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, errVehiculoInexistente):
+		fallar(c, errores.VehiculoNoEncontrado)
+	case errors.Is(err, errVehiculoAlto):
+		fallar(c, errores.VehiculoMuyAlto)
+	case errors.Is(err, errVehiculoTipo):
+		fallar(c, errores.SinLugarParaTipo)
+	default:
+		return false
+	}
+	return true
+}
+
+type vehiculoInput struct {
+	Patente   *string  `json:"patente" binding:"omitempty,patente"`
+	Tipo      *string  `json:"tipo" binding:"omitempty,oneof=auto moto camioneta"` // tiposVehiculo
+	AlturaM   *float64 `json:"altura_m" binding:"omitempty,gt=0,max=5"`
+	Electrico *bool    `json:"electrico"`
+	Alias     *string  `json:"alias" binding:"omitempty,max=50"`
+}
+
+func registrarRutasVehiculos(r *gin.Engine) {
+	// GET /vehiculos
+	r.GET("/vehiculos", AuthMiddleware(), func(c *gin.Context) {
+		rows, err := db.Query(`SELECT `+columnasVehiculo+` FROM vehiculos WHERE user_id = ? ORDER BY id`, c.GetInt("userID"))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer rows.Close()
+		list := []Vehiculo{}
+		for rows.Next() {
+			if v, err := scanVehiculo(rows); err == nil {
+				list = append(list, v)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"vehiculos": list})
+	})
+
+	// POST /vehiculos { "patente", "tipo", "altura_m"?, "electrico"?, "alias"? }
+	r.POST("/vehiculos", AuthMiddleware(), func(c *gin.Context) {
+		var in vehiculoInput
+		if !bindJSON(c, &in) {
+			return
+		}
+		if in.Patente == nil {
+			responderInvalidos(c, []errorValidacion{{Campo: "patente", Motivo: "obligatorio"}})
+			return
+		}
+		p := normalizarPatente(*in.Patente)
+		in.Patente = &p
+		if in.Tipo == nil {
+			auto := "auto"
+			in.Tipo = &auto
+		}
+		electrico := in.Electrico != nil && *in.Electrico
+		userID := c.GetInt("userID")
+		res, err := db.Exec(`
+			INSERT INTO vehiculos (user_id, patente, tipo, altura_m, electrico, alias)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			userID, *in.Patente, *in.Tipo, in.AlturaM, electrico, in.Alias)
+		if esDuplicado(err) {
+			fallar(c, errores.VehiculoDuplicado)
+			return
+		}
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		id, _ := res.LastInsertId()
+		v, err := vehiculoDeUsuario(userID, int(id))
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, v)
+	})
+
+	// PATCH /vehiculos/:id
+	r.PATCH("/vehiculos/:id", AuthMiddleware(), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		var in vehiculoInput
+		if !bindJSON(c, &in) {
+			return
+		}
+		if in.Patente != nil {
+			p := normalizarPatente(*in.Patente)
+			in.Patente = &p
+		}
+		userID := c.GetInt("userID")
+		if _, err := vehiculoDeUsuario(userID, id); err != nil {
+			if !errorVehiculoJSON(c, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+
+		sets := []string{}
+		args := []interface{}{}
+		if in.Patente != nil {
+			sets, args = append(sets, "patente = ?"), append(args, *in.Patente)
+		}
+		if in.Tipo != nil {
+			sets, args = append(sets, "tipo = ?"), append(args, *in.Tipo)
+		}
+		if in.AlturaM != nil {
+			sets, args = append(sets, "altura_m = ?"), append(args, *in.AlturaM)
+		}
+		if in.Electrico != nil {
+			sets, args = append(sets, "electrico = ?"), append(args, *in.Electrico)
+		}
+		if in.Alias != nil {
+			sets, args = append(sets, "alias = ?"), append(args, *in.Alias)
+		}
+		if len(sets) > 0 {
+			_, err := db.Exec(`UPDATE vehiculos SET `+strings.Join(sets, ", ")+` WHERE id = ? AND user_id = ?`, append(args, id, userID)...)
+			if esDuplicado(err) {
+				fallar(c, errores.VehiculoDuplicado)
+				return
+			}
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+		}
+		v, err := vehiculoDeUsuario(userID, id)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, v)
+	})
+
+	// DELETE /vehiculos/:id
+	r.DELETE("/vehiculos/:id", AuthMiddleware(), func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			fallar(c, errores.IDInvalido)
+			return
+		}
+		// primero que sea del usuario: las reservas de vehículos ajenos no se
+		// informan
+		userID := c.GetInt("userID")
+		if _, err := vehiculoDeUsuario(userID, id); err != nil {
+			if !errorVehiculoJSON(c, err) {
+				dbErr(c, err)
+			}
+			return
+		}
+		conReservas, err := patentesConReservas(db, userID, `v.id = ?`, id)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if len(conReservas) > 0 {
+			fallar(c, errores.VehiculoConReservas)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM vehiculos WHERE id = ? AND user_id = ?`, id, userID)
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		if aff, _ := res.RowsAffected(); aff == 0 {
+			fallar(c, errores.VehiculoNoEncontrado)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// PATCH /estacionamientos/:id/lugares/:numero { "tipo": "moto" | null }
+	// Define para qué tipo de vehículo es un lugar (null = cualquiera).
+	r.PATCH("/estacionamientos/:id/lugares/:numero", AuthMiddleware(),
+		RequirePermissionEn(estIDParam("id"), permLugaresEditar), func(c *gin.Context) {
+			numero, err := strconv.Atoi(c.Param("numero"))
+			if err != nil || numero <= 0 {
+				fallar(c, errores.IDInvalido)
+				return
+			}
+			var in struct {
+				Tipo *string `json:"tipo"`
+			}
+			if err := c.ShouldBindJSON(&in); err != nil || (in.Tipo != nil && !contiene(tiposVehiculo, *in.Tipo)) {
+				fallar(c, errores.FormatoInvalido)
+				return
+			}
+			res, err := db.Exec(`UPDATE lugares SET tipo = ? WHERE estacionamiento_id = ? AND numero = ?`,
+				in.Tipo, c.GetInt("estacionamientoID"), numero)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			if aff, _ := res.RowsAffected(); aff == 0 {
+				var n int
+				if err := db.QueryRow(`SELECT COUNT(1) FROM lugares WHERE estacionamiento_id = ? AND numero = ?`,
+					c.GetInt("estacionamientoID"), numero).Scan(&n); err != nil || n == 0 {
+					fallar(c, errores.LugarNoEncontrado)
+					return
+				}
+			}
+			c.JSON(http.StatusOK, gin.H{"mensaje": "OK"})
+		})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ----------- VENCIMIENTO DE RESERVAS Y NO-SHOWS -------------
+// Un proceso en segundo plano recorre las reservas activas cada
+// RESERVAS_VENCIMIENTO_INTERVALO (1m):
+//   - pasa a checked_in si el lugar asignado está ocupado o hubo una entrada
+//     del vehículo de la reserva (eventos_acceso) desde RESERVAS_GRACIA antes
+//     del inicio;
+//   - sin llegada pasados RESERVAS_GRACIA (15m) desde el inicio, la reserva
+//     pasa a no_show y libera el cupo. Si no tiene vehículo ni lugar la
+//     llegada solo se registra a mano (POST
+//     /estacionamientos/:id/reservas/:reservaId/llegada), así que pasa a
+//     expired y no cuenta para la suspensión;
+//   - las checked_in que terminaron pasan a completed.
+// Con NO_SHOW_LIMITE (3, 0 desactiva) no-shows en NO_SHOW_VENTANA (720h) el
+// usuario no puede reservar durante NO_SHOW_SUSPENSION (336h).
+
+func enteroEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("⚠️ %s inválido (%q), usando %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func reservasGracia() time.Duration { return duracionEnv("RESERVAS_GRACIA", 15*time.Minute) }
+
+type politicaNoShow struct {
+	Limite     int
+	Ventana    time.Duration
+	Suspension time.Duration
+}
+
+func politicaNoShowDesdeEnv() politicaNoShow {
+	return politicaNoShow{
+		Limite:     enteroEnv("NO_SHOW_LIMITE", 3),
+		Ventana:    duracionEnv("NO_SHOW_VENTANA", 30*24*time.Hour),
+		Suspension: duracionEnv("NO_SHOW_SUSPENSION", 14*24*time.Hour),
+	}
+}
+
+// reservasSuspendidas devuelve hasta cuándo el usuario no puede reservar
+// (nil si puede).
+func reservasSuspendidas(userID int, ahora time.Time) (*time.Time, error) {
+	var hasta sql.NullTime
+	if err := db.QueryRow(`SELECT reservas_suspendidas_hasta FROM usuarios WHERE id = ?`, userID).Scan(&hasta); err != nil {
+		return nil, err
+	}
+	if !hasta.Valid || !hasta.Time.After(ahora) {
+		return nil, nil
+	}
+	return &hasta.Time, nil
+}
+
+// transicionarLote aplica una transición del proceso en su propia
+// transacción: el FOR UPDATE de transicionarReservas retiene las filas y el
+// cambio de estado queda junto con su historial.
+func transicionarLote(filtro string, args []interface{}, hacia estadoReserva, ahora time.Time) ([]reservaTransicionada, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	out, err := transicionarReservas(tx, filtro, args, hacia, nil, nil, ahora)
+	if err != nil {
+		return nil, err
+	}
+	return out, tx.Commit()
+}
+
+// marcarLlegadas pasa a checked_in las reservas confirmadas en curso (o que
+// empiezan dentro de la gracia) con el conductor adentro. El lugar ocupado
+// solo cuenta una vez empezada la franja: antes puede ser el auto de otro.
+func marcarLlegadas(ahora time.Time, gracia time.Duration) error {
+	_, err := transicionarLote(`
+		r.estado = ? AND r.desde <= ? AND r.hasta > ?
+		  AND ((r.desde <= ? AND EXISTS (SELECT 1 FROM lugares l
+		               WHERE l.estacionamiento_id = r.estacionamiento_id AND l.numero = r.numero AND l.ocupado = 1))
+		    OR EXISTS (SELECT 1 FROM eventos_acceso ev
+		               WHERE ev.estacionamiento_id = r.estacionamiento_id AND ev.vehiculo_id = r.vehiculo_id
+		                 AND ev.tipo = 'entrada' AND ev.ocurrido_at >= r.desde - INTERVAL ? SECOND AND ev.ocurrido_at <= ?))`,
+		[]interface{}{reservaConfirmada, ahora.Add(gracia), ahora, ahora, int(gracia.Seconds()), ahora},
+		reservaEnCurso, ahora)
+	return err
+}
+
+// vencerNoShows pasa a no_show las confirmadas sin llegada pasada la gracia
+// (o ya terminadas) y devuelve los usuarios afectados. Las pending que
+// llegan al inicio sin confirmarse vencen como expired, igual que las
+// confirmadas sin vehículo ni lugar: sin forma de detectar la llegada no se
+// le cuenta un no-show al conductor.
+func vencerNoShows(ahora time.Time, gracia time.Duration) ([]int, error) {
+	if _, err := transicionarLote(`r.estado = ? AND r.desde <= ?`,
+		[]interface{}{reservaPendiente, ahora}, reservaVencida, ahora); err != nil {
+		return nil, err
+	}
+	if _, err := transicionarLote(`r.estado = ? AND (r.desde <= ? OR r.hasta <= ?)
+		  AND r.vehiculo_id IS NULL AND r.numero IS NULL`,
+		[]interface{}{reservaConfirmada, ahora.Add(-gracia), ahora}, reservaVencida, ahora); err != nil {
+		return nil, err
+	}
+	vencidas, err := transicionarLote(`r.estado = ? AND (r.desde <= ? OR r.hasta <= ?)
+		  AND (r.vehiculo_id IS NOT NULL OR r.numero IS NOT NULL)`,
+		[]interface{}{reservaConfirmada, ahora.Add(-gracia), ahora}, reservaNoShow, ahora)
+	usuarios := make([]int, 0, len(vencidas))
+	for _, v := range vencidas {
+		usuarios = append(usuarios, v.UserID)
+	}
+	return usuarios, err
+}
+
+// suspenderReincidentes aplica la suspensión a quienes llegaron al límite.
+func suspenderReincidentes(usuarios []int, ahora time.Time, p politicaNoShow) error {
+	if p.Limite == 0 {
+		return nil
+	}
+	vistos := map[int]bool{}
+	for _, uid := range usuarios {
+		if vistos[uid] {
+			continue
+		}
+		vistos[uid] = true
+		var n int
+		if err := db.QueryRow(`
+			SELECT COUNT(1) FROM reservas
+			WHERE user_id = ? AND estado = ? AND finalizada_at > ?`,
+			uid, reservaNoShow, ahora.Add(-p.Ventana)).Scan(&n); err != nil {
+			return err
+		}
+		if n < p.Limite {
+			continue
+		}
+		if _, err := db.Exec(`UPDATE usuarios SET reservas_suspendidas_hasta = ? WHERE id = ?`, ahora.Add(p.Suspension), uid); err != nil {
+			return err
+		}
+		log.Printf("⛔ Usuario %d sin reservas hasta %s (%d no-shows)", uid, ahora.Add(p.Suspension).Format(time.RFC3339), n)
+	}
+	return nil
+}
+
+// procesarVencimientos es una pasada del proceso; las transiciones son
+// condicionales al estado, así que varias instancias pueden correrlo a la vez.
+func procesarVencimientos(ahora time.Time, gracia time.Duration, p politicaNoShow) error {
+	if err := marcarLlegadas(ahora, gracia); err != nil {
+		return err
+	}
+	usuarios, err := vencerNoShows(ahora, gracia)
+	if len(usuarios) > 0 {
+		log.Printf("⌛ %d reservas vencidas por no-show", len(usuarios))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := transicionarLote(`r.estado = ? AND r.hasta <= ?`,
+		[]interface{}{reservaEnCurso, ahora}, reservaCompletada, ahora); err != nil {
+		return err
+	}
+	return suspenderReincidentes(usuarios, ahora, p)
+}
+
+func iniciarVencimientoReservas() {
+	intervalo := duracionEnv("RESERVAS_VENCIMIENTO_INTERVALO", time.Minute)
+	gracia := reservasGracia()
+	politica := politicaNoShowDesdeEnv()
+	go func() {
+		for range time.Tick(intervalo) {
+			if err := procesarVencimientos(time.Now(), gracia, politica); err != nil {
+				log.Println("❌ Error venciendo reservas:", err)
+			}
+		}
+	}()
+}
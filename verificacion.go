@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"proyecto-parking-back/errores"
+)
+
+// ----------- VERIFICACIÓN DE EMAIL / RESET DE PASSWORD -------------
+// Tokens aleatorios de un solo uso con vencimiento. En `tokens_usuario` se
+// guarda solo el hash; el token en claro viaja únicamente en el mail.
+
+const (
+	tokenVerificarEmail = "verify"
+	tokenResetPassword  = "reset"
+)
+
+var errTokenInvalido = errors.New("token inválido o vencido")
+
+func appURL() string {
+	if v := os.Getenv("APP_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func requiereEmailVerificado() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFIED") == "true"
+}
+
+// crearTokenUsuario invalida los tokens pendientes del mismo tipo y emite uno nuevo.
+func crearTokenUsuario(userID int, tipo, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		UPDATE tokens_usuario SET used_at = ?
+		WHERE user_id = ? AND tipo = ? AND used_at IS NULL`, now, userID, tipo); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO tokens_usuario (token_hash, user_id, tipo, email, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		hashToken(token), userID, tipo, email, now, now.Add(ttl)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// consumirTokenUsuario marca el token como usado dentro de tx y devuelve su
+// usuario y el email asociado.
+func consumirTokenUsuario(tx *sql.Tx, token, tipo string) (userID int, email string, err error) {
+	var (
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		mail      sql.NullString
+	)
+	h := hashToken(token)
+	err = tx.QueryRow(`
+		SELECT user_id, email, expires_at, used_at
+		FROM tokens_usuario WHERE token_hash = ? AND tipo = ? FOR UPDATE`, h, tipo,
+	).Scan(&userID, &mail, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", errTokenInvalido
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return 0, "", errTokenInvalido
+	}
+	if _, err := tx.Exec(`UPDATE tokens_usuario SET used_at = ? WHERE token_hash = ?`, time.Now(), h); err != nil {
+		return 0, "", err
+	}
+	return userID, mail.String, nil
+}
+
+// enviarMail manda en segundo plano para no demorar (ni delatar) la respuesta.
+func enviarMail(to, subject, body string) {
+	go func() {
+		if err := mailer.Send(to, subject, body); err != nil {
+			log.Println("❌ Error enviando mail a", to, ":", err)
+		}
+	}()
+}
+
+func enviarVerificacionEmail(userID int, email string) error {
+	token, err := crearTokenUsuario(userID, tokenVerificarEmail, email, 48*time.Hour)
+	if err != nil {
+		return err
+	}
+	link := appURL() + "/verify-email?token=" + url.QueryEscape(token)
+	enviarMail(email, "Verificá tu email",
+		"Hola! Para confirmar tu cuenta entrá a:\n\n"+link+"\n\nEl link vence en 48 horas.")
+	return nil
+}
+
+func registrarRutasVerificacion(r *gin.Engine) {
+	// POST /password/forgot { "email": "..." }
+	// Responde igual exista o no el email.
+	r.POST("/password/forgot", func(c *gin.Context) {
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Email) == "" {
+			fallar(c, errores.FormatoInvalido)
+			return
+		}
+		email := normalizarEmail(body.Email)
+
+		claves := []string{
+			claveLimite("recupero", "ip", c.ClientIP()),
+			claveLimite("recupero", "email", email),
+		}
+		for _, k := range claves {
+			if !controlarLimite(c, k, limiteRecupero) {
+				return
+			}
+		}
+
+		// las cuentas eliminadas no reciben mail de recupero
+		var (
+			userID     int
+			registrado string
+		)
+		err := db.QueryRow(`SELECT id, email FROM usuarios WHERE email = ? AND eliminado_at IS NULL`, email).Scan(&userID, &registrado)
+		if err == nil {
+			token, err := crearTokenUsuario(userID, tokenResetPassword, registrado, time.Hour)
+			if err != nil {
+				dbErr(c, err)
+				return
+			}
+			link := appURL() + "/reset-password?token=" + url.QueryEscape(token)
+			enviarMail(registrado, "Recuperar contraseña",
+				"Para elegir una contraseña nueva entrá a:\n\n"+link+"\n\nEl link vence en 1 hora. Si no lo pediste, ignorá este mail.")
+		} else if err != sql.ErrNoRows {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"mensaje": "Si el email está registrado te enviamos un link"})
+	})
+
+	// POST /password/reset { "token": "...", "password": "..." }
+	r.POST("/password/reset", func(c *gin.Context) {
+		var body struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required,password"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			fallar(c, errores.Interno)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+
+		userID, email, err := consumirTokenUsuario(tx, body.Token, tokenResetPassword)
+		if err != nil {
+			if errors.Is(err, errTokenInvalido) {
+				fallar(c, errores.EnlaceInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		// quien recibió el mail demostró ser dueño del email
+		if _, err := tx.Exec(`UPDATE usuarios SET password_hash = ?, email_verificado = 1 WHERE id = ?`, string(hash), userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := aceptarInvitacionesStaff(tx, userID, email, 0); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := tx.Exec(`UPDATE sesiones SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, time.Now(), userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// GET /verify-email?token=...
+	r.GET("/verify-email", func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			fallar(c, errores.EnlaceInvalido)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			dbErr(c, err)
+			return
+		}
+		defer tx.Rollback()
+
+		userID, email, err := consumirTokenUsuario(tx, token, tokenVerificarEmail)
+		if err != nil {
+			if errors.Is(err, errTokenInvalido) {
+				fallar(c, errores.EnlaceInvalido)
+				return
+			}
+			dbErr(c, err)
+			return
+		}
+		// si el email cambió desde que se mandó el link, el token no aplica
+		var actual string
+		if err := tx.QueryRow(`SELECT email FROM usuarios WHERE id = ?`, userID).Scan(&actual); err != nil || actual != email {
+			fallar(c, errores.EnlaceInvalido)
+			return
+		}
+		if _, err := tx.Exec(`UPDATE usuarios SET email_verificado = 1 WHERE id = ?`, userID); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if _, err := aceptarInvitacionesStaff(tx, userID, email, 0); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// POST /verify-email/reenviar (protegido)
+	r.POST("/verify-email/reenviar", AuthMiddleware(), func(c *gin.Context) {
+		var email string
+		var verificado int
+		if err := db.QueryRow(`SELECT email, email_verificado FROM usuarios WHERE id = ?`, c.GetInt("userID")).
+			Scan(&email, &verificado); err != nil {
+			dbErr(c, err)
+			return
+		}
+		if verificado == 1 {
+			fallar(c, errores.EmailYaVerificado)
+			return
+		}
+		if err := enviarVerificacionEmail(c.GetInt("userID"), email); err != nil {
+			dbErr(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}